@@ -17,6 +17,8 @@ package main
 
 import (
 	"github.com/BurntSushi/toml"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"github.com/je4/zmedia/v2/pkg/mediaserver"
 	"log"
 	"os"
 	"path/filepath"
@@ -35,10 +37,12 @@ func (d *duration) UnmarshalText(text []byte) error {
 }
 
 type Cfg_database struct {
-	ServerType string
-	DSN        string
-	ConnMax    int `toml:"connection_max"`
-	Schema     string
+	ServerType  string
+	DSN         string
+	ConnMax     int `toml:"connection_max"`
+	Schema      string
+	Locking     bool     `toml:"locking"`
+	LockTimeout duration `toml:"locktimeout"`
 }
 
 type Cfg_S3 struct {
@@ -73,6 +77,106 @@ type Indexer struct {
 	IdentTimeout duration `toml:"identtimeout"`
 	Convert      string   `toml:"convert"`
 	Identify     string   `toml:"identify"`
+	ExifTool     string   `toml:"exiftool"`
+	PDFInfo      string   `toml:"pdfinfo"`
+	PDFToText    string   `toml:"pdftotext"`
+	TextTimeout  duration `toml:"texttimeout"`
+}
+
+type Loudness struct {
+	Integrated float64 `toml:"integrated"`
+	TruePeak   float64 `toml:"truepeak"`
+	LRA        float64 `toml:"lra"`
+}
+
+type FFMpeg struct {
+	FFMpeg   string   `toml:"ffmpeg"`
+	Timeout  duration `toml:"timeout"`
+	Loudness Loudness `toml:"loudness"`
+}
+
+type Image struct {
+	SVGDensity float64  `toml:"svgdensity"`
+	SVGMaxSize int64    `toml:"svgmaxsize"`
+	DCRaw      string   `toml:"dcraw"`
+	RawTimeout duration `toml:"rawtimeout"`
+}
+
+// fonts for the caption action. font is the default, fonts are selected with the face parameter
+type Caption struct {
+	Font  string            `toml:"font"`
+	Fonts map[string]string `toml:"fonts"`
+}
+
+// georeferenced maps
+type GDAL struct {
+	GDALInfo string   `toml:"gdalinfo"`
+	GDALWarp string   `toml:"gdalwarp"`
+	Timeout  duration `toml:"timeout"`
+}
+
+// text recognition with tesseract. languages like deu+eng
+type OCR struct {
+	Tesseract string   `toml:"tesseract"`
+	Languages string   `toml:"languages"`
+	Density   float64  `toml:"density"`
+	MaxPages  int      `toml:"maxpages"`
+	Ingest    bool     `toml:"ingest"`
+	Timeout   duration `toml:"timeout"`
+}
+
+// pdf page rendering and conversion of office documents
+type Document struct {
+	Density float64  `toml:"density"`
+	SOffice string   `toml:"soffice"`
+	Timeout duration `toml:"timeout"`
+}
+
+// removal of derivatives, if a storage exceeds its quota. quota in bytes per storage name
+type Eviction struct {
+	Interval duration         `toml:"interval"`
+	Strategy string           `toml:"strategy"`
+	Quota    map[string]int64 `toml:"quota"`
+}
+
+// hits of cache entries are written to the database every interval
+type Access struct {
+	Interval duration `toml:"interval"`
+}
+
+// asynchronous creation of derivatives of actions. jobs running longer than timeout are restarted
+type Jobs struct {
+	Actions []string `toml:"actions"`
+	Workers int      `toml:"workers"`
+	Poll    duration `toml:"poll"`
+	Timeout duration `toml:"timeout"`
+}
+
+// failed derivatives are not created again before backoff, which doubles up to maxbackoff.
+// placeholder is delivered instead of the error
+type Failure struct {
+	Backoff     duration `toml:"backoff"`
+	MaxBackoff  duration `toml:"maxbackoff"`
+	Placeholder string   `toml:"placeholder"`
+}
+
+type Tiles struct {
+	TileSize int64  `toml:"tilesize"`
+	Overlap  int64  `toml:"overlap"`
+	Format   string `toml:"format"`
+}
+
+// name => action/param1/param2/...
+type Presets map[string]string
+
+// master type => preset names, which are created after ingest
+type Warmup map[string][]string
+
+type Srcset struct {
+	Name   string   `toml:"name"`
+	Widths []int64  `toml:"widths"`
+	Sizes  string   `toml:"sizes"`
+	Params []string `toml:"params"`
 }
 
 type Action struct {
@@ -93,6 +197,7 @@ type Config struct {
 	StaticCacheControl string       `toml:"staticcachecontrol"`
 	JWTKey             string       `toml:"jwtkey"`
 	JWTAlg             []string     `toml:"jwtalg"`
+	AdminToken         string       `toml:"admintoken"`
 	LinkTokenExp       duration     `toml:"linktokenexp"`
 	MediaPrefix        string       `toml:"mediaprefix"`
 	DataPrefix         string       `toml:"dataprefix"`
@@ -104,9 +209,23 @@ type Config struct {
 	S3                 []Cfg_S3     `toml:"s3"`
 	SSHTunnel          SSHTunnel    `toml:"sshtunnel"`
 	Indexer            Indexer      `toml:"indexer"`
+	FFMpeg             FFMpeg       `toml:"ffmpeg"`
+	Image              Image        `toml:"image"`
+	Caption            Caption      `toml:"caption"`
+	Tiles              Tiles        `toml:"tiles"`
+	GDAL               GDAL         `toml:"gdal"`
+	OCR                OCR          `toml:"ocr"`
+	Document           Document     `toml:"document"`
+	Eviction           Eviction     `toml:"eviction"`
+	Access             Access       `toml:"access"`
+	Jobs               Jobs         `toml:"jobs"`
+	Failure            Failure      `toml:"failure"`
 	Tempdir            string       `toml:"tempdir"`
 	Tempsize           int64        `toml:"tempsize"`
 	Actions            []Action     `toml:"action"`
+	Srcset             []Srcset     `toml:"srcset"`
+	Presets            Presets      `toml:"presets"`
+	Warmup             Warmup       `toml:"warmup"`
 }
 
 func LoadConfig(fp string) Config {
@@ -125,5 +244,72 @@ func LoadConfig(fp string) Config {
 	conf.HTTPSAddrExt = strings.TrimRight(conf.HTTPSAddrExt, "/")
 	conf.HTTP3AddrExt = strings.TrimRight(conf.HTTP3AddrExt, "/")
 	conf.StaticFolder = filepath.Clean(conf.StaticFolder)
+	if conf.FFMpeg.Loudness.Integrated == 0 {
+		conf.FFMpeg.Loudness.Integrated = media.DefaultLoudnessTarget.Integrated
+	}
+	if conf.FFMpeg.Loudness.TruePeak == 0 {
+		conf.FFMpeg.Loudness.TruePeak = media.DefaultLoudnessTarget.TruePeak
+	}
+	if conf.FFMpeg.Loudness.LRA == 0 {
+		conf.FFMpeg.Loudness.LRA = media.DefaultLoudnessTarget.LRA
+	}
+	if conf.Image.SVGDensity == 0 {
+		conf.Image.SVGDensity = media.DefaultSVGDensity
+	}
+	if conf.Image.SVGMaxSize == 0 {
+		conf.Image.SVGMaxSize = media.DefaultSVGMaxSize
+	}
+	if conf.Indexer.TextTimeout.Duration == 0 {
+		conf.Indexer.TextTimeout.Duration = time.Minute
+	}
+	if conf.Image.RawTimeout.Duration == 0 {
+		conf.Image.RawTimeout.Duration = 2 * time.Minute
+	}
+	if conf.GDAL.Timeout.Duration == 0 {
+		conf.GDAL.Timeout.Duration = time.Minute
+	}
+	if conf.DB.LockTimeout.Duration == 0 {
+		conf.DB.LockTimeout.Duration = 10 * time.Minute
+	}
+	if conf.OCR.Density == 0 {
+		conf.OCR.Density = media.DefaultOCRDensity
+	}
+	if conf.OCR.MaxPages == 0 {
+		conf.OCR.MaxPages = media.DefaultOCRMaxPages
+	}
+	if conf.OCR.Timeout.Duration == 0 {
+		conf.OCR.Timeout.Duration = 10 * time.Minute
+	}
+	if conf.Document.Density == 0 {
+		conf.Document.Density = media.DefaultPDFDensity
+	}
+	if conf.Document.Timeout.Duration == 0 {
+		conf.Document.Timeout.Duration = 2 * time.Minute
+	}
+	if conf.Access.Interval.Duration == 0 {
+		conf.Access.Interval.Duration = time.Minute
+	}
+	if conf.Jobs.Workers == 0 {
+		conf.Jobs.Workers = 1
+	}
+	if conf.Jobs.Poll.Duration == 0 {
+		conf.Jobs.Poll.Duration = 10 * time.Second
+	}
+	if conf.Jobs.Timeout.Duration == 0 {
+		conf.Jobs.Timeout.Duration = 2 * time.Hour
+	}
+	if conf.Failure.Backoff.Duration == 0 {
+		conf.Failure.Backoff.Duration = time.Minute
+	}
+	if conf.Failure.MaxBackoff.Duration == 0 {
+		conf.Failure.MaxBackoff.Duration = 24 * time.Hour
+	}
+	if conf.Tiles.TileSize == 0 {
+		conf.Tiles.TileSize = mediaserver.DefaultTileSize
+		conf.Tiles.Overlap = mediaserver.DefaultTileOverlap
+	}
+	if conf.Tiles.Format == "" {
+		conf.Tiles.Format = mediaserver.DefaultTileFormat
+	}
 	return conf
 }
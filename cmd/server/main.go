@@ -13,12 +13,20 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
 	cfgfile := flag.String("cfg", "./search.toml", "locations of config file")
+	evict := flag.Bool("evict", false, "evict derivatives of storages above quota and exit")
+	warmup := flag.String("warmup", "", "create the warm-up presets of all masters of a collection and exit")
+	invalidate := flag.String("invalidate", "", "invalidate changed masters of a collection or a single master <collection>/<signature> and exit")
+	force := flag.Bool("force", false, "invalidate all masters of the collection")
+	verify := flag.Bool("verify", false, "check the files of all cache entries, remove broken entries and exit")
+	regenerate := flag.Bool("regenerate", false, "create removed derivatives again while verifying")
+	parallel := flag.Int("parallel", 4, "number of masters, which are warmed up at the same time, also in the background after ingest")
 	flag.Parse()
 	config := LoadConfig(*cfgfile)
 
@@ -118,7 +126,15 @@ func main() {
 		config.Indexer.FFProbe,
 		config.Indexer.Identify,
 		config.Indexer.Convert,
+		config.Indexer.ExifTool,
+		config.FFMpeg.FFMpeg,
+		config.Image.DCRaw,
+		config.GDAL.GDALInfo,
+		config.Indexer.PDFInfo,
+		config.Indexer.PDFToText,
 		config.Indexer.IdentTimeout.Duration,
+		config.FFMpeg.Timeout.Duration,
+		config.Indexer.TextTimeout.Duration,
 	)
 	if err != nil {
 		log.Errorf("cannot instantiate indexer: %v", err)
@@ -155,11 +171,12 @@ func main() {
 	}
 
 	var actions = []media.Action{}
-	ia, err := media.NewImageAction()
+	ia, err := media.NewImageAction(config.Image.SVGDensity, config.Image.SVGMaxSize)
 	if err != nil {
 		log.Panicf("cannot instantiate ImageAction: %v", err)
 		return
 	}
+	ia.SetCaptionFonts(config.Caption.Fonts, config.Caption.Font)
 	actions = append(actions, ia)
 
 	mh, err := mediaserver.NewMediaHandler(config.MediaPrefix, mdb, idx, pbx, config.Tempdir, log, fss, actions)
@@ -168,6 +185,173 @@ func main() {
 		return
 	}
 
+	ia.SetOverlayLoader(mh.OpenOverlay)
+	mh.SetLocking(config.DB.Locking, config.DB.LockTimeout.Duration)
+
+	var presets []mediaserver.SrcsetPreset
+	for _, ss := range config.Srcset {
+		presets = append(presets, mediaserver.SrcsetPreset{
+			Name:   ss.Name,
+			Widths: ss.Widths,
+			Sizes:  ss.Sizes,
+			Params: ss.Params,
+		})
+	}
+	mh.SetSrcsetPresets(presets)
+	mh.SetPresets(config.Presets)
+	mh.SetWarmup(config.Warmup, *parallel)
+	mh.SetAdminToken(config.AdminToken)
+	mh.SetFailures(config.Failure.Backoff.Duration, config.Failure.MaxBackoff.Duration, config.Failure.Placeholder)
+	mh.SetTileOptions(mediaserver.TileOptions{
+		TileSize: config.Tiles.TileSize,
+		Overlap:  config.Tiles.Overlap,
+		Format:   config.Tiles.Format,
+	})
+
+	if config.GDAL.GDALWarp != "" {
+		geo, err := media.NewGeoWarper(config.GDAL.GDALWarp, mh.GetTempFolder(), config.GDAL.Timeout.Duration)
+		if err != nil {
+			log.Panicf("cannot instantiate geo warper: %v", err)
+			return
+		}
+		mh.SetGeoWarper(geo)
+	}
+
+	if config.OCR.Tesseract != "" {
+		ocr, err := media.NewOCR(
+			config.OCR.Tesseract,
+			mh.GetTempFolder(),
+			config.OCR.Languages,
+			config.OCR.Density,
+			config.OCR.MaxPages,
+			config.OCR.Timeout.Duration,
+		)
+		if err != nil {
+			log.Panicf("cannot instantiate ocr: %v", err)
+			return
+		}
+		mh.SetOCR(ocr, config.OCR.Ingest)
+	}
+
+	if config.Image.DCRaw != "" {
+		raw, err := media.NewRawDecoder(config.Image.DCRaw, mh.GetTempFolder(), config.Image.RawTimeout.Duration)
+		if err != nil {
+			log.Panicf("cannot instantiate raw decoder: %v", err)
+			return
+		}
+		ia.SetRawDecoder(raw)
+	}
+
+	if config.FFMpeg.FFMpeg != "" {
+		ffm, err := media.NewFFMpeg(
+			config.FFMpeg.FFMpeg,
+			config.Indexer.FFProbe,
+			mh.GetTempFolder(),
+			config.FFMpeg.Timeout.Duration,
+			media.LoudnessTarget{
+				Integrated: config.FFMpeg.Loudness.Integrated,
+				TruePeak:   config.FFMpeg.Loudness.TruePeak,
+				LRA:        config.FFMpeg.Loudness.LRA,
+			},
+		)
+		if err != nil {
+			log.Panicf("cannot instantiate ffmpeg: %v", err)
+			return
+		}
+		va, err := media.NewVideoAction(ffm)
+		if err != nil {
+			log.Panicf("cannot instantiate VideoAction: %v", err)
+			return
+		}
+		mh.AddAction(va)
+		aa, err := media.NewAudioAction(ffm)
+		if err != nil {
+			log.Panicf("cannot instantiate AudioAction: %v", err)
+			return
+		}
+		mh.AddAction(aa)
+	}
+
+	pa, err := media.NewPDFAction(config.Document.Density, mh.GetTempFolder())
+	if err != nil {
+		log.Panicf("cannot instantiate PDFAction: %v", err)
+		return
+	}
+	mh.AddAction(pa)
+	if config.Document.SOffice != "" {
+		oa, err := media.NewOfficeAction(config.Document.SOffice, mh.GetTempFolder(), config.Document.Timeout.Duration, pa)
+		if err != nil {
+			log.Panicf("cannot instantiate OfficeAction: %v", err)
+			return
+		}
+		mh.AddAction(oa)
+	}
+
+	ar, err := mediaserver.NewAccessRecorder(mdb, log)
+	if err != nil {
+		log.Errorf("cannot instantiate access recorder: %v", err)
+		return
+	}
+	mh.SetAccessRecorder(ar)
+
+	ev, err := mediaserver.NewEvictor(mh, mdb, config.Eviction.Quota, config.Eviction.Strategy, log)
+	if err != nil {
+		log.Errorf("cannot instantiate evictor: %v", err)
+		return
+	}
+	if *verify {
+		if err := mh.Verify(*regenerate); err != nil {
+			log.Errorf("verification failed: %v", err)
+		}
+		return
+	}
+	if *invalidate != "" {
+		if parts := strings.SplitN(*invalidate, "/", 2); len(parts) == 2 {
+			if err := mh.InvalidateMaster(parts[0], parts[1]); err != nil {
+				log.Errorf("cannot invalidate %s: %v", *invalidate, err)
+			}
+		} else {
+			num, err := mh.CheckCollection(*invalidate, true, *force)
+			if err != nil {
+				log.Errorf("cannot check collection %s: %v", *invalidate, err)
+			}
+			log.Infof("collection %s: %v masters invalidated", *invalidate, num)
+		}
+		return
+	}
+	if *warmup != "" {
+		if err := mh.WarmupCollection(*warmup, *parallel, func(done, failed, total int64) {
+			log.Infof("warmup %s: %v/%v masters, %v failed", *warmup, done, total, failed)
+		}); err != nil {
+			log.Errorf("cannot warm up collection %s: %v", *warmup, err)
+		}
+		return
+	}
+	if *evict {
+		if err := ev.Evict(); err != nil {
+			log.Errorf("cannot evict derivatives: %v", err)
+		}
+		return
+	}
+	if len(config.Eviction.Quota) > 0 && config.Eviction.Interval.Duration > 0 {
+		ev.Start(config.Eviction.Interval.Duration)
+		defer ev.Stop()
+	}
+
+	ar.Start(config.Access.Interval.Duration)
+	defer ar.Stop()
+
+	if len(config.Jobs.Actions) > 0 {
+		jq, err := mediaserver.NewJobQueue(mh, mdb, config.Jobs.Actions, config.Jobs.Workers, config.Jobs.Poll.Duration, config.Jobs.Timeout.Duration, log)
+		if err != nil {
+			log.Errorf("cannot instantiate job queue: %v", err)
+			return
+		}
+		mh.SetJobQueue(jq)
+		jq.Start()
+		defer jq.Stop()
+	}
+
 	go func() {
 		if err := srv.ListenAndServeHTTP3(config.CertPEM, config.KeyPEM, mh); err != nil {
 			log.Errorf("services ended: %v", err)
@@ -0,0 +1,84 @@
+--
+-- Schema changes after media_public-dump-20210115.sql
+-- Apply in order, every block is run once.
+--
+
+--
+-- Container masters (zip, tar) with child masters for their members
+--
+
+ALTER TYPE public.master_type ADD VALUE IF NOT EXISTS 'archive';
+
+--
+-- Full text search on recognized text of masters
+--
+
+CREATE INDEX IF NOT EXISTS master_ocr_text_idx ON public.master
+    USING gin (to_tsvector('simple', COALESCE(metadata->'ocr'->>'text', '')));
+
+--
+-- Full text search on embedded text of pdf masters
+--
+
+CREATE INDEX IF NOT EXISTS master_pdf_text_idx ON public.master
+    USING gin (to_tsvector('simple', COALESCE(metadata->'pdf'->>'text', '')));
+
+--
+-- Usage counter and index for the eviction of derivatives
+--
+
+ALTER TABLE public.cache ADD COLUMN IF NOT EXISTS hits bigint DEFAULT 0 NOT NULL;
+
+CREATE INDEX IF NOT EXISTS cache_storage_lastaccess_idx ON public.cache
+    USING btree (storageid, lastaccess);
+
+--
+-- Asynchronous creation of derivatives
+--
+
+CREATE TABLE IF NOT EXISTS public.job (
+    jobid bigserial PRIMARY KEY,
+    collectionid bigint NOT NULL REFERENCES public.collection(collectionid) ON DELETE CASCADE,
+    signature text NOT NULL,
+    action text NOT NULL,
+    param text DEFAULT ''::text NOT NULL,
+    status text DEFAULT 'queued'::text NOT NULL,
+    error text,
+    cacheid bigint REFERENCES public.cache(cacheid) ON DELETE SET NULL,
+    created timestamp with time zone DEFAULT now() NOT NULL,
+    started timestamp with time zone,
+    finished timestamp with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS job_pending_idx ON public.job
+    USING btree (collectionid, signature, action, param) WHERE status IN ('queued', 'running');
+
+CREATE INDEX IF NOT EXISTS job_status_idx ON public.job USING btree (status, jobid);
+
+--
+-- Errors of derivatives, which are not created again before retryafter
+-- master.status describes the object of the master only, one derivative of a master may fail
+-- while the others work. so the errors are stored per action and parameters with their own backoff
+--
+
+CREATE TABLE IF NOT EXISTS public.failure (
+    masterid bigint NOT NULL REFERENCES public.master(masterid) ON DELETE CASCADE,
+    action text NOT NULL,
+    param text DEFAULT ''::text NOT NULL,
+    error text NOT NULL,
+    failures bigint DEFAULT 1 NOT NULL,
+    firstfailure timestamp with time zone DEFAULT now() NOT NULL,
+    lastfailure timestamp with time zone DEFAULT now() NOT NULL,
+    retryafter timestamp with time zone NOT NULL,
+    PRIMARY KEY (masterid, action, param)
+);
+
+CREATE INDEX IF NOT EXISTS failure_lastfailure_idx ON public.failure USING btree (lastfailure);
+
+--
+-- Derivatives were stored as data/<file> instead of <filebase>/<file>
+--
+
+UPDATE public.cache c SET path = s.filebase || '/' || substring(c.path from 6)
+    FROM public.storage s
+    WHERE c.storageid = s.storageid AND c.path LIKE 'data/%' AND s.filebase <> 'data';
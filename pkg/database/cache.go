@@ -1,6 +1,9 @@
 package database
 
-import "github.com/goph/emperror"
+import (
+	"github.com/goph/emperror"
+	"time"
+)
 
 type Cache struct {
 	db           *MediaDatabase `json:"-"`
@@ -17,6 +20,9 @@ type Cache struct {
 	Width        int64          `json:"width,omitempty"`
 	Height       int64          `json:"height,omitempty"`
 	Duration     int64          `json:"duration,omitempty"`
+	CacheTime    time.Time      `json:"cachetime,omitempty"`
+	LastAccess   time.Time      `json:"lastaccess,omitempty"`
+	Hits         int64          `json:"hits,omitempty"`
 }
 
 func NewCache(db *MediaDatabase, id, collectionid, masterid int64, action string, params string, mimetype string, filesize int64, path string, width, height, duration int64) (*Cache, error) {
@@ -72,3 +78,8 @@ func (c *Cache) GetMaster() (*Master, error) {
 func (c *Cache) Store() error {
 	return c.db.db.StoreCache(c.db, c)
 }
+
+// Delete removes the database entry, the file has to be removed by the caller
+func (c *Cache) Delete() error {
+	return c.db.db.DeleteCache(c.db, c)
+}
@@ -1,18 +1,33 @@
 package database
 
+import (
+	"encoding/json"
+	"github.com/goph/emperror"
+	"strings"
+)
+
+// CollectionConfig is stored in the json column of the collection
+type CollectionConfig struct {
+	// name => action/param1/param2/...
+	Presets map[string]string `json:"presets,omitempty"`
+	// master type => preset names, which are created after ingest
+	Warmup map[string][]string `json:"warmup,omitempty"`
+}
+
 type Collection struct {
-	db          *MediaDatabase `json:"-"`
-	estate      *Estate        `json:"-"`
-	storage     *Storage       `json:"-"`
-	Id          int64          `json:"id"`
-	EstateId    int64          `json:"estateid"`
-	StorageId   int64          `json:"storageid"`
-	Name        string         `json:"string"`
-	Description string         `json:"description,omitempty"`
-	ZoteroGroup int64          `json:"zoterogroup,omitempty"`
+	db          *MediaDatabase   `json:"-"`
+	estate      *Estate          `json:"-"`
+	storage     *Storage         `json:"-"`
+	Id          int64            `json:"id"`
+	EstateId    int64            `json:"estateid"`
+	StorageId   int64            `json:"storageid"`
+	Name        string           `json:"string"`
+	Description string           `json:"description,omitempty"`
+	ZoteroGroup int64            `json:"zoterogroup,omitempty"`
+	Config      CollectionConfig `json:"config"`
 }
 
-func NewCollection(mdb *MediaDatabase, id int64, storage *Storage, estate *Estate, name, description string, zoteroGroup int64) (*Collection, error) {
+func NewCollection(mdb *MediaDatabase, id int64, storage *Storage, estate *Estate, name, description string, zoteroGroup int64, jsonstr string) (*Collection, error) {
 	coll := &Collection{
 		db:          mdb,
 		Id:          id,
@@ -24,6 +39,11 @@ func NewCollection(mdb *MediaDatabase, id int64, storage *Storage, estate *Estat
 		Description: description,
 		ZoteroGroup: zoteroGroup,
 	}
+	if strings.TrimSpace(jsonstr) != "" {
+		if err := json.Unmarshal([]byte(jsonstr), &coll.Config); err != nil {
+			return nil, emperror.Wrapf(err, "cannot unmarshal config of collection %s - %s", name, jsonstr)
+		}
+	}
 	return coll, nil
 }
 
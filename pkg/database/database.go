@@ -1,6 +1,9 @@
 package database
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var ErrNotFound = errors.New("database: could not find entry")
 
@@ -24,8 +27,30 @@ type Database interface {
 	GetMasterById(mdb *MediaDatabase, collection *Collection, masterid int64) (*Master, error)
 	CreateMaster(mdb *MediaDatabase, collection *Collection, signature, urn string, parent *Master) (*Master, error)
 	StoreMaster(db *MediaDatabase, m *Master) error
+	GetMasterSignatures(mdb *MediaDatabase, collection *Collection, callback func(signature string) error) error
+	GetChildSignatures(mdb *MediaDatabase, parent *Master, callback func(signature string) error) error
 
 	GetCacheByMaster(mdb *MediaDatabase, master *Master, action string, paramstr string) (*Cache, error)
 	GetCache(mdb *MediaDatabase, collection, signature, action string, paramstr string) (*Cache, error)
+	GetCachesByMaster(mdb *MediaDatabase, master *Master, callback func(cache *Cache) error) error
+	GetCachesByStorage(mdb *MediaDatabase, storage *Storage, afterId, limit int64, callback func(cache *Cache) error) error
 	StoreCache(mdb *MediaDatabase, cache *Cache) error
+	DeleteCache(mdb *MediaDatabase, cache *Cache) error
+	UpdateCacheAccess(mdb *MediaDatabase, hits map[int64]int64) error
+	GetCacheUsage(mdb *MediaDatabase, storage *Storage) (int64, error)
+	Lock(mdb *MediaDatabase, key int64, timeout time.Duration) (func() error, error)
+
+	CreateJob(mdb *MediaDatabase, collection *Collection, signature, action, paramstr string) (*Job, error)
+	GetJob(mdb *MediaDatabase, jobid int64) (*Job, error)
+	NextJob(mdb *MediaDatabase) (*Job, error)
+	StoreJob(mdb *MediaDatabase, job *Job) error
+	ResetJobs(mdb *MediaDatabase, timeout time.Duration) (int64, error)
+
+	GetFailure(mdb *MediaDatabase, collection, signature, action, paramstr string) (*Failure, error)
+	GetFailures(mdb *MediaDatabase, collection *Collection, active bool, limit int64, callback func(failure *Failure) error) error
+	StoreFailure(mdb *MediaDatabase, collection, signature, action, paramstr, errstr string, backoff, maxBackoff time.Duration) (*Failure, error)
+	DeleteFailure(mdb *MediaDatabase, masterid int64, action, paramstr string) error
+	DeleteFailures(mdb *MediaDatabase, master *Master) error
+
+	GetEvictionCandidates(mdb *MediaDatabase, storage *Storage, lfu bool, limit int64, callback func(cache *Cache) error) error
 }
@@ -0,0 +1,28 @@
+package database
+
+import "time"
+
+// Failure is the last error of a derivative, which is not created again before RetryAfter
+type Failure struct {
+	db           *MediaDatabase `json:"-"`
+	MasterId     int64          `json:"masterid"`
+	CollectionId int64          `json:"collectionid"`
+	Collection   string         `json:"collection"`
+	Signature    string         `json:"signature"`
+	Action       string         `json:"action"`
+	Params       string         `json:"params"`
+	Error        string         `json:"error"`
+	Failures     int64          `json:"failures"`
+	FirstFailure time.Time      `json:"firstfailure"`
+	LastFailure  time.Time      `json:"lastfailure"`
+	RetryAfter   time.Time      `json:"retryafter"`
+}
+
+// Active checks, whether the derivative has to wait for the next try
+func (f *Failure) Active() bool {
+	return time.Now().Before(f.RetryAfter)
+}
+
+func (f *Failure) Delete() error {
+	return f.db.db.DeleteFailure(f.db, f.MasterId, f.Action, f.Params)
+}
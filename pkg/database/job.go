@@ -0,0 +1,36 @@
+package database
+
+import "time"
+
+// states of a job
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobError   = "error"
+)
+
+// Job is the asynchronous creation of a derivative
+type Job struct {
+	db           *MediaDatabase `json:"-"`
+	Id           int64          `json:"id"`
+	CollectionId int64          `json:"collectionid"`
+	Signature    string         `json:"signature"`
+	Action       string         `json:"action"`
+	Params       string         `json:"params"`
+	Status       string         `json:"status"`
+	Error        string         `json:"error,omitempty"`
+	CacheId      int64          `json:"cacheid,omitempty"`
+	Position     int64          `json:"position,omitempty"` // in the queue of waiting jobs
+	Created      time.Time      `json:"created"`
+	Started      *time.Time     `json:"started,omitempty"`
+	Finished     *time.Time     `json:"finished,omitempty"`
+}
+
+func (j *Job) GetCollection() (*Collection, error) {
+	return j.db.GetCollectionById(j.CollectionId)
+}
+
+func (j *Job) Store() error {
+	return j.db.db.StoreJob(j.db, j)
+}
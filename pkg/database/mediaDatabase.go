@@ -121,6 +121,9 @@ func (db *MediaDatabase) CreateEstate(name, description string) (*Estate, error)
 	return db.db.CreateEstate(db, name, description)
 }
 
+func (db *MediaDatabase) GetStorages(callback func(storage *Storage) error) error {
+	return db.db.GetStorages(db, callback)
+}
 func (db *MediaDatabase) GetStorageById(id int64) (*Storage, error) {
 	db.mutex[DT_Storage].Lock()
 	defer db.mutex[DT_Storage].Unlock()
@@ -271,6 +274,16 @@ func (db *MediaDatabase) GetMasterById(collection *Collection, masterid int64) (
 	}
 	return master, nil
 }
+
+// GetMasterSignatures lists the signatures of all masters of collection
+func (db *MediaDatabase) GetMasterSignatures(collection *Collection, callback func(signature string) error) error {
+	return db.db.GetMasterSignatures(db, collection, callback)
+}
+
+// GetChildSignatures lists the signatures of the members of a container master
+func (db *MediaDatabase) GetChildSignatures(parent *Master, callback func(signature string) error) error {
+	return db.db.GetChildSignatures(db, parent, callback)
+}
 func (db *MediaDatabase) CreateMaster(collection *Collection, signature, urn string, parent *Master) (*Master, error) {
 	return db.db.CreateMaster(db, collection, signature, urn, parent)
 }
@@ -303,3 +316,84 @@ func (db *MediaDatabase) GetCacheByMaster(master *Master, action string, paramst
 
 	return db.db.GetCacheByMaster(db, master, action, paramstr)
 }
+
+// GetCachesByMaster lists the master cache and all derivatives of master
+func (db *MediaDatabase) GetCachesByMaster(master *Master, callback func(cache *Cache) error) error {
+	return db.db.GetCachesByMaster(db, master, callback)
+}
+
+// GetCachesByStorage lists up to limit entries of storage with id greater than afterId
+func (db *MediaDatabase) GetCachesByStorage(storage *Storage, afterId, limit int64, callback func(cache *Cache) error) error {
+	return db.db.GetCachesByStorage(db, storage, afterId, limit, callback)
+}
+
+// UpdateCacheAccess sets lastaccess and adds the number of hits of cacheid => hits
+func (db *MediaDatabase) UpdateCacheAccess(hits map[int64]int64) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	return db.db.UpdateCacheAccess(db, hits)
+}
+
+// GetCacheUsage sums up the size of all derivatives in storage. masters are not counted
+func (db *MediaDatabase) GetCacheUsage(storage *Storage) (int64, error) {
+	return db.db.GetCacheUsage(db, storage)
+}
+
+/*
+GetEvictionCandidates lists derivatives of storage, which were not used for the longest time.
+with lfu, the least often used derivatives come first
+*/
+func (db *MediaDatabase) GetEvictionCandidates(storage *Storage, lfu bool, limit int64, callback func(cache *Cache) error) error {
+	return db.db.GetEvictionCandidates(db, storage, lfu, limit, callback)
+}
+
+/*
+Lock blocks until the lock key is acquired or timeout is over. locks are valid for all instances,
+which use the same database. the returned function releases the lock
+*/
+func (db *MediaDatabase) Lock(key int64, timeout time.Duration) (func() error, error) {
+	return db.db.Lock(db, key, timeout)
+}
+
+// CreateJob queues the creation of a derivative. a waiting or running job for the same derivative is reused
+func (db *MediaDatabase) CreateJob(collection *Collection, signature, action, paramstr string) (*Job, error) {
+	return db.db.CreateJob(db, collection, signature, strings.ToLower(action), paramstr)
+}
+
+func (db *MediaDatabase) GetJob(jobid int64) (*Job, error) {
+	return db.db.GetJob(db, jobid)
+}
+
+// NextJob marks the oldest waiting job as running. ErrNotFound, if no job is waiting
+func (db *MediaDatabase) NextJob() (*Job, error) {
+	return db.db.NextJob(db)
+}
+
+// ResetJobs queues jobs again, which are running longer than timeout
+func (db *MediaDatabase) ResetJobs(timeout time.Duration) (int64, error) {
+	return db.db.ResetJobs(db, timeout)
+}
+
+// GetFailure loads the last error of a derivative. ErrNotFound, if there is none
+func (db *MediaDatabase) GetFailure(collection, signature, action, paramstr string) (*Failure, error) {
+	return db.db.GetFailure(db, collection, signature, strings.ToLower(action), paramstr)
+}
+
+// GetFailures lists the failed derivatives of collection (all collections, if nil). with active only those waiting for retry
+func (db *MediaDatabase) GetFailures(collection *Collection, active bool, limit int64, callback func(failure *Failure) error) error {
+	return db.db.GetFailures(db, collection, active, limit, callback)
+}
+
+/*
+StoreFailure records an error of a derivative. the next try is allowed after backoff,
+which doubles with every failure up to maxBackoff. ErrNotFound, if the master does not exist
+*/
+func (db *MediaDatabase) StoreFailure(collection, signature, action, paramstr, errstr string, backoff, maxBackoff time.Duration) (*Failure, error) {
+	return db.db.StoreFailure(db, collection, signature, strings.ToLower(action), paramstr, errstr, backoff, maxBackoff)
+}
+
+// DeleteFailures removes the errors of all derivatives of master
+func (db *MediaDatabase) DeleteFailures(master *Master) error {
+	return db.db.DeleteFailures(db, master)
+}
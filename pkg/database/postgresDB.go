@@ -1,13 +1,17 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"github.com/goph/emperror"
 	"github.com/gosimple/slug"
+	"github.com/lib/pq"
 	"github.com/op/go-logging"
 	"strings"
+	"time"
 )
 
 type PostgresDB struct {
@@ -67,7 +71,7 @@ func (db *PostgresDB) GetStorageById(mdb *MediaDatabase, storageid int64) (*Stor
 	case nil:
 
 	default:
-		return nil, emperror.Wrapf(err, "cannot load storage #$v", storageid)
+		return nil, emperror.Wrapf(err, "cannot load storage #%v", storageid)
 	}
 	stor, err := NewStorage(mdb, storageid, Name, FileBase, DataDir, VideoDir, SubmasterDir, TempDir, JWTKey.String)
 	if err != nil {
@@ -92,7 +96,7 @@ func (db *PostgresDB) GetStorageByName(mdb *MediaDatabase, name string) (*Storag
 	case nil:
 
 	default:
-		return nil, emperror.Wrapf(err, "cannot load storage $v", name)
+		return nil, emperror.Wrapf(err, "cannot load storage %v", name)
 	}
 	stor, err := NewStorage(mdb, StorageId, name, FileBase, DataDir, VideoDir, SubmasterDir, TempDir, JWTKey.String)
 	if err != nil {
@@ -158,7 +162,7 @@ func (db *PostgresDB) GetEstateById(mdb *MediaDatabase, EstateID int64) (*Estate
 	case nil:
 
 	default:
-		return nil, emperror.Wrapf(err, "cannot load estate #$v", EstateID)
+		return nil, emperror.Wrapf(err, "cannot load estate #%v", EstateID)
 	}
 	est, err := NewEstate(mdb, EstateID, Name, Description)
 	if err != nil {
@@ -180,7 +184,7 @@ func (db *PostgresDB) GetEstateByName(mdb *MediaDatabase, Name string) (*Estate,
 	case nil:
 
 	default:
-		return nil, emperror.Wrapf(err, "cannot load storage $v", Name)
+		return nil, emperror.Wrapf(err, "cannot load storage %v", Name)
 	}
 	est, err := NewEstate(mdb, EstateID, Name, Description)
 	if err != nil {
@@ -229,7 +233,7 @@ func (db *PostgresDB) GetCollections(mdb *MediaDatabase, callback func(storage *
 		if err != nil {
 			return emperror.Wrapf(err, "cannot get estate #%v", EstateID)
 		}
-		coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup)
+		coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup, JSONStr)
 		if err != nil {
 			return emperror.Wrapf(err, "cannot instantiate collection [%v] %s", CollectionId, Name)
 		}
@@ -266,7 +270,7 @@ func (db *PostgresDB) GetCollectionById(mdb *MediaDatabase, CollectionId int64)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot get estate #%v", EstateID)
 	}
-	coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup)
+	coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup, JSONStr.String)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate collection [%v] %s", CollectionId, Name)
 	}
@@ -290,7 +294,7 @@ func (db *PostgresDB) GetCollectionByName(mdb *MediaDatabase, Name string) (*Col
 	case nil:
 
 	default:
-		return nil, emperror.Wrapf(err, "cannot load collection $v", Name)
+		return nil, emperror.Wrapf(err, "cannot load collection %v", Name)
 	}
 	storage, err := mdb.GetStorageById(StorageID)
 	if err != nil {
@@ -300,7 +304,7 @@ func (db *PostgresDB) GetCollectionByName(mdb *MediaDatabase, Name string) (*Col
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot get estate #%v", EstateID)
 	}
-	coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup)
+	coll, err := NewCollection(mdb, CollectionId, storage, estate, Name, Description, ZoteroGroup, JSONStr.String)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate collection [%v] %s", CollectionId, Name)
 	}
@@ -335,7 +339,7 @@ func (db *PostgresDB) GetMaster(mdb *MediaDatabase, collection *Collection, sign
 	var Mimetype, ErrStatus, SHA256, MetadataJSON sql.NullString
 	switch err := row.Scan(&MasterId, &URN, &Type, &SubType, &ObjectType, &Status, &ParentId, &Mimetype, &ErrStatus, &SHA256, &MetadataJSON); err {
 	case sql.ErrNoRows:
-		return nil, fmt.Errorf("master %s/%s does not exist", collection.Name, signature)
+		return nil, ErrNotFound
 	case nil:
 
 	default:
@@ -344,11 +348,11 @@ func (db *PostgresDB) GetMaster(mdb *MediaDatabase, collection *Collection, sign
 	var Metadata map[string]interface{}
 	if MetadataJSON.Valid {
 		if err := json.Unmarshal([]byte(MetadataJSON.String), &Metadata); err != nil {
-			return nil, emperror.Wrapf(err, "cannot unmarshal metadata for %s/%s - %s", collection.Name, signature, MetadataJSON)
+			return nil, emperror.Wrapf(err, "cannot unmarshal metadata for %s/%s - %s", collection.Name, signature, MetadataJSON.String)
 		}
 	}
 	master, err := NewMaster(mdb, collection, MasterId, ParentId.Int64, signature, URN, Status, Type.String,
-		SubType.String, Mimetype.String, "", ObjectType.String, SHA256.String, Metadata)
+		SubType.String, Mimetype.String, ErrStatus.String, ObjectType.String, strings.TrimSpace(SHA256.String), Metadata)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate master %s/%s", collection.Name, signature)
 	}
@@ -375,16 +379,65 @@ func (db *PostgresDB) GetMasterById(mdb *MediaDatabase, collection *Collection,
 	var Metadata map[string]interface{}
 	if MetadataJSON.Valid {
 		if err := json.Unmarshal([]byte(MetadataJSON.String), &Metadata); err != nil {
-			return nil, emperror.Wrapf(err, "cannot unmarshal metadata for %s/%s - %s", collection.Name, Signature, MetadataJSON)
+			return nil, emperror.Wrapf(err, "cannot unmarshal metadata for %s/%s - %s", collection.Name, Signature, MetadataJSON.String)
 		}
 	}
 	master, err := NewMaster(mdb, collection, masterid, ParentId.Int64, Signature, URN, Status, Type.String,
-		SubType.String, Mimetype.String, "", ObjectType.String, SHA256.String, Metadata)
+		SubType.String, Mimetype.String, ErrStatus.String, ObjectType.String, strings.TrimSpace(SHA256.String), Metadata)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate master %s/%s", collection.Name, Signature)
 	}
 	return master, nil
 }
+func (db *PostgresDB) GetMasterSignatures(mdb *MediaDatabase, collection *Collection, callback func(signature string) error) error {
+	sqlstr := fmt.Sprintf("SELECT signature FROM %s.master WHERE collectionid=$1 ORDER BY masterid", db.schema)
+	params := []interface{}{collection.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, params)
+	rows, err := db.db.Query(sqlstr, params...)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot execute sql %s", sqlstr)
+	}
+	defer rows.Close()
+	var Signature string
+	for rows.Next() {
+		if err := rows.Scan(&Signature); err != nil {
+			return emperror.Wrapf(err, "cannot scan result from %s", sqlstr)
+		}
+		if err := callback(Signature); err != nil {
+			return emperror.Wrapf(err, "cannot callback for master %s/%s", collection.Name, Signature)
+		}
+	}
+	return nil
+}
+func (db *PostgresDB) GetChildSignatures(mdb *MediaDatabase, parent *Master, callback func(signature string) error) error {
+	sqlstr := fmt.Sprintf("SELECT signature FROM %s.master WHERE parentid=$1 ORDER BY masterid", db.schema)
+	params := []interface{}{parent.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, params)
+	rows, err := db.db.Query(sqlstr, params...)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot execute sql %s", sqlstr)
+	}
+	// callbacks may change the children, so the result is read completely before
+	var signatures []string
+	for rows.Next() {
+		var Signature string
+		if err := rows.Scan(&Signature); err != nil {
+			rows.Close()
+			return emperror.Wrapf(err, "cannot scan result from %s", sqlstr)
+		}
+		signatures = append(signatures, Signature)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return emperror.Wrapf(err, "cannot read result from %s", sqlstr)
+	}
+	for _, signature := range signatures {
+		if err := callback(signature); err != nil {
+			return emperror.Wrapf(err, "cannot callback for master %s", signature)
+		}
+	}
+	return nil
+}
 func (db *PostgresDB) CreateMaster(mdb *MediaDatabase, collection *Collection, signature, urn string, parent *Master) (*Master, error) {
 	sqlstr := fmt.Sprintf("INSERT INTO %s.master (collectionid, signature, urn, status, parentid)"+
 		"     VALUES($1, $2, $3, $4, $5) RETURNING masterid", db.schema)
@@ -476,8 +529,13 @@ func (db *PostgresDB) StoreMaster(mdb *MediaDatabase, master *Master) error {
 
 func (db *PostgresDB) StoreCache(mdb *MediaDatabase, cache *Cache) error {
 	if cache.Id == 0 {
+		// another instance could have created the same entry in the meantime
 		sqlstr := fmt.Sprintf("INSERT INTO %s.cache (collectionid,masterid,storageid,action,param,path,filesize,mimetype,width,height,duration)"+
-			"        VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning cacheid", db.schema)
+			"        VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"+
+			"   ON CONFLICT (masterid, action, param) DO UPDATE"+
+			"   SET storageid=EXCLUDED.storageid, path=EXCLUDED.path, filesize=EXCLUDED.filesize, mimetype=EXCLUDED.mimetype,"+
+			"       width=EXCLUDED.width, height=EXCLUDED.height, duration=EXCLUDED.duration"+
+			"   returning cacheid", db.schema)
 		sqlparams := []interface{}{
 			cache.collection.Id,
 			cache.MasterId,
@@ -572,7 +630,7 @@ func (db *PostgresDB) GetCacheByMaster(mdb *MediaDatabase, master *Master, actio
 		return nil, emperror.Wrapf(err, "cannot get collection from master #%v.%v", master.CollectionId, master.Id)
 	}
 
-	sqlstr := fmt.Sprintf("SELECT cacheid, storageid, collectionid, width, height, duration, mimetype, filesize, path"+
+	sqlstr := fmt.Sprintf("SELECT cacheid, storageid, collectionid, width, height, duration, mimetype, filesize, path, cachetime"+
 		" FROM %s.cache"+
 		" WHERE masterid=$1 AND action=$2 AND param=$3", db.schema)
 	sqlparams := []interface{}{
@@ -587,7 +645,8 @@ func (db *PostgresDB) GetCacheByMaster(mdb *MediaDatabase, master *Master, actio
 	var Mimetype string
 	var Filesize int64
 	var Path string
-	switch err := row.Scan(&CacheId, &StorageId, &CollectionId, &Width, &Height, &Duration, &Mimetype, &Filesize, &Path); err {
+	var CacheTime time.Time
+	switch err := row.Scan(&CacheId, &StorageId, &CollectionId, &Width, &Height, &Duration, &Mimetype, &Filesize, &Path, &CacheTime); err {
 	case sql.ErrNoRows:
 		return nil, fmt.Errorf("cache %s/%s/%s/%s does not exist", coll.Name, master.Signature, action, paramstr)
 	case nil:
@@ -599,6 +658,414 @@ func (db *PostgresDB) GetCacheByMaster(mdb *MediaDatabase, master *Master, actio
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate cache %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
 	}
+	cache.CacheTime = CacheTime
+	return cache, nil
+
+}
+
+func (db *PostgresDB) DeleteCache(mdb *MediaDatabase, cache *Cache) error {
+	sqlstr := fmt.Sprintf("DELETE FROM %s.cache WHERE cacheid=$1", db.schema)
+	sqlparams := []interface{}{cache.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	if _, err := db.db.Exec(sqlstr, sqlparams...); err != nil {
+		return emperror.Wrapf(err, "%s - %v", sqlstr, sqlparams)
+	}
+	return nil
+}
+
+func (db *PostgresDB) UpdateCacheAccess(mdb *MediaDatabase, hits map[int64]int64) error {
+	var ids, counts []int64
+	for id, count := range hits {
+		ids = append(ids, id)
+		counts = append(counts, count)
+	}
+	// one statement for all entries
+	sqlstr := fmt.Sprintf("UPDATE %s.cache AS c SET lastaccess=now(), hits=c.hits+a.hits"+
+		" FROM unnest($1::bigint[], $2::bigint[]) AS a(cacheid, hits)"+
+		" WHERE c.cacheid=a.cacheid", db.schema)
+	sqlparams := []interface{}{pq.Array(ids), pq.Array(counts)}
+	db.logger.Debugf("SQL: %s - %v entries", sqlstr, len(ids))
+	if _, err := db.db.Exec(sqlstr, sqlparams...); err != nil {
+		return emperror.Wrapf(err, "cannot execute %s", sqlstr)
+	}
+	return nil
+}
+
+// the ingested master has no parameters, everything else can be rebuilt from it
+const cacheDerivativeCondition = "NOT (action='master' AND COALESCE(param, '')='')"
+
+func (db *PostgresDB) GetCacheUsage(mdb *MediaDatabase, storage *Storage) (int64, error) {
+	sqlstr := fmt.Sprintf("SELECT COALESCE(SUM(filesize), 0) FROM %s.cache WHERE storageid=$1 AND %s", db.schema, cacheDerivativeCondition)
+	sqlparams := []interface{}{storage.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	var usage int64
+	if err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&usage); err != nil {
+		return 0, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	return usage, nil
+}
+
+const cacheColumns = "cacheid, collectionid, masterid, action, COALESCE(param, ''), mimetype, filesize, path, width, height, duration, cachetime, lastaccess, hits"
+
+func scanCache(mdb *MediaDatabase, row interface{ Scan(...interface{}) error }) (*Cache, error) {
+	var CacheId, CollectionId, MasterId int64
+	var Action, Params, Mimetype, Path string
+	var Filesize, Width, Height, Duration, Hits int64
+	var CacheTime, LastAccess time.Time
+	if err := row.Scan(&CacheId, &CollectionId, &MasterId, &Action, &Params, &Mimetype, &Filesize, &Path, &Width, &Height, &Duration, &CacheTime, &LastAccess, &Hits); err != nil {
+		return nil, err
+	}
+	cache, err := NewCache(mdb, CacheId, CollectionId, MasterId, Action, Params, Mimetype, Filesize, Path, Width, Height, Duration)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot instantiate cache #%v", CacheId)
+	}
+	cache.CacheTime = CacheTime
+	cache.LastAccess = LastAccess
+	cache.Hits = Hits
 	return cache, nil
+}
+
+// queryCaches reads the result completely before the callbacks, which may delete entries
+func (db *PostgresDB) queryCaches(mdb *MediaDatabase, sqlstr string, sqlparams []interface{}, callback func(cache *Cache) error) error {
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	rows, err := db.db.Query(sqlstr, sqlparams...)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	var caches []*Cache
+	for rows.Next() {
+		cache, err := scanCache(mdb, rows)
+		if err != nil {
+			rows.Close()
+			return emperror.Wrapf(err, "cannot scan result from %s", sqlstr)
+		}
+		caches = append(caches, cache)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return emperror.Wrapf(err, "cannot read result from %s", sqlstr)
+	}
+	for _, cache := range caches {
+		if err := callback(cache); err != nil {
+			return emperror.Wrapf(err, "cannot callback for cache #%v", cache.Id)
+		}
+	}
+	return nil
+}
+
+func (db *PostgresDB) GetEvictionCandidates(mdb *MediaDatabase, storage *Storage, lfu bool, limit int64, callback func(cache *Cache) error) error {
+	order := "lastaccess ASC"
+	if lfu {
+		order = "hits ASC, lastaccess ASC"
+	}
+	sqlstr := fmt.Sprintf("SELECT %s"+
+		" FROM %s.cache"+
+		" WHERE storageid=$1 AND %s"+
+		" ORDER BY %s"+
+		" LIMIT $2", cacheColumns, db.schema, cacheDerivativeCondition, order)
+	return db.queryCaches(mdb, sqlstr, []interface{}{storage.Id, limit}, callback)
+}
+
+// waiting time between two attempts to get an advisory lock
+const lockPollInterval = 200 * time.Millisecond
+
+/*
+the lock is polled, so that waiting requests do not occupy a connection. after timeout, the waiting
+is given up
+*/
+func (db *PostgresDB) Lock(mdb *MediaDatabase, key int64, timeout time.Duration) (func() error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		unlock, err := db.tryLock(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if unlock != nil {
+			return unlock, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout after %v waiting for lock %v", timeout, key)
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+/*
+tryLock returns nil, if the lock is held by another session. the session advisory lock is held by a
+dedicated connection without open transaction. the connection is closed with the unlock, a broken
+connection releases the lock too
+*/
+func (db *PostgresDB) tryLock(ctx context.Context, key int64) (func() error, error) {
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot get connection")
+	}
+	sqlstr := "SELECT pg_try_advisory_lock($1)"
+	db.logger.Debugf("SQL: %s - %v", sqlstr, key)
+	var locked bool
+	if err := conn.QueryRowContext(ctx, sqlstr, key).Scan(&locked); err != nil {
+		// a canceled query could have got the lock
+		conn.Raw(func(driverConn interface{}) error {
+			return driver.ErrBadConn
+		})
+		conn.Close()
+		return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, key)
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil
+	}
+	return func() error {
+		ctx := context.Background()
+		defer conn.Close()
+		sqlstr := "SELECT pg_advisory_unlock($1)"
+		db.logger.Debugf("SQL: %s - %v", sqlstr, key)
+		var unlocked bool
+		if err := conn.QueryRowContext(ctx, sqlstr, key).Scan(&unlocked); err != nil {
+			// the lock must not stay with a session in the pool
+			conn.Raw(func(driverConn interface{}) error {
+				return driver.ErrBadConn
+			})
+			return emperror.Wrapf(err, "cannot release lock %v", key)
+		}
+		if !unlocked {
+			return fmt.Errorf("lock %v was not held", key)
+		}
+		return nil
+	}, nil
+}
+
+const jobColumns = "jobid, collectionid, signature, action, param, status, COALESCE(error, ''), COALESCE(cacheid, 0), created, started, finished"
+
+func (db *PostgresDB) CreateJob(mdb *MediaDatabase, collection *Collection, signature, action, paramstr string) (*Job, error) {
+	// only one waiting or running job per derivative
+	sqlstr := fmt.Sprintf("INSERT INTO %s.job (collectionid, signature, action, param, status)"+
+		" VALUES($1, $2, $3, $4, $5)"+
+		" ON CONFLICT (collectionid, signature, action, param) WHERE status IN ('queued', 'running') DO NOTHING"+
+		" RETURNING jobid", db.schema)
+	sqlparams := []interface{}{collection.Id, signature, action, paramstr, JobQueued}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	var jobid int64
+	switch err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&jobid); err {
+	case nil:
+	case sql.ErrNoRows:
+		sqlstr = fmt.Sprintf("SELECT jobid FROM %s.job"+
+			" WHERE collectionid=$1 AND signature=$2 AND action=$3 AND param=$4 AND status IN ('queued', 'running')", db.schema)
+		sqlparams = sqlparams[:4]
+		db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+		if err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&jobid); err != nil {
+			return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+		}
+	default:
+		return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	return db.GetJob(mdb, jobid)
+}
+
+func (db *PostgresDB) GetJob(mdb *MediaDatabase, jobid int64) (*Job, error) {
+	sqlstr := fmt.Sprintf("SELECT %s,"+
+		" (SELECT COUNT(*) FROM %s.job AS q WHERE q.status=$2 AND q.jobid<j.jobid)"+
+		" FROM %s.job AS j WHERE jobid=$1", jobColumns, db.schema, db.schema)
+	sqlparams := []interface{}{jobid, JobQueued}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	job := &Job{db: mdb}
+	var Started, Finished sql.NullTime
+	var Before int64
+	switch err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&job.Id, &job.CollectionId, &job.Signature, &job.Action, &job.Params,
+		&job.Status, &job.Error, &job.CacheId, &job.Created, &Started, &Finished, &Before); err {
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	case nil:
+	default:
+		return nil, emperror.Wrapf(err, "cannot load job #%v", jobid)
+	}
+	if Started.Valid {
+		job.Started = &Started.Time
+	}
+	if Finished.Valid {
+		job.Finished = &Finished.Time
+	}
+	if job.Status == JobQueued {
+		job.Position = Before + 1
+	}
+	return job, nil
+}
+
+func (db *PostgresDB) NextJob(mdb *MediaDatabase) (*Job, error) {
+	// skip locked allows several instances to take jobs at the same time
+	sqlstr := fmt.Sprintf("UPDATE %s.job SET status=$1, started=now()"+
+		" WHERE jobid=(SELECT jobid FROM %s.job WHERE status=$2 ORDER BY jobid LIMIT 1 FOR UPDATE SKIP LOCKED)"+
+		" RETURNING jobid", db.schema, db.schema)
+	sqlparams := []interface{}{JobRunning, JobQueued}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	var jobid int64
+	switch err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&jobid); err {
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	case nil:
+	default:
+		return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	return db.GetJob(mdb, jobid)
+}
+
+func (db *PostgresDB) StoreJob(mdb *MediaDatabase, job *Job) error {
+	var cacheid sql.NullInt64
+	if job.CacheId != 0 {
+		cacheid.Valid = true
+		cacheid.Int64 = job.CacheId
+	}
+	sqlstr := fmt.Sprintf("UPDATE %s.job SET status=$1, error=$2, cacheid=$3,"+
+		" finished=(CASE WHEN $1 IN ('done', 'error') THEN now() ELSE NULL END)"+
+		" WHERE jobid=$4", db.schema)
+	sqlparams := []interface{}{job.Status, job.Error, cacheid, job.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	if _, err := db.db.Exec(sqlstr, sqlparams...); err != nil {
+		return emperror.Wrapf(err, "%s - %v", sqlstr, sqlparams)
+	}
+	return nil
+}
+
+func (db *PostgresDB) ResetJobs(mdb *MediaDatabase, timeout time.Duration) (int64, error) {
+	sqlstr := fmt.Sprintf("UPDATE %s.job SET status=$1, started=NULL"+
+		" WHERE status=$2 AND started < now() - make_interval(secs => $3)", db.schema)
+	sqlparams := []interface{}{JobQueued, JobRunning, timeout.Seconds()}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	result, err := db.db.Exec(sqlstr, sqlparams...)
+	if err != nil {
+		return 0, emperror.Wrapf(err, "%s - %v", sqlstr, sqlparams)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return 0, emperror.Wrap(err, "cannot get affected rows")
+	}
+	return num, nil
+}
+
+func (db *PostgresDB) GetCachesByMaster(mdb *MediaDatabase, master *Master, callback func(cache *Cache) error) error {
+	sqlstr := fmt.Sprintf("SELECT %s"+
+		" FROM %s.cache"+
+		" WHERE masterid=$1", cacheColumns, db.schema)
+	return db.queryCaches(mdb, sqlstr, []interface{}{master.Id}, callback)
+}
+
+func (db *PostgresDB) GetCachesByStorage(mdb *MediaDatabase, storage *Storage, afterId, limit int64, callback func(cache *Cache) error) error {
+	sqlstr := fmt.Sprintf("SELECT %s"+
+		" FROM %s.cache"+
+		" WHERE storageid=$1 AND cacheid>$2"+
+		" ORDER BY cacheid"+
+		" LIMIT $3", cacheColumns, db.schema)
+	return db.queryCaches(mdb, sqlstr, []interface{}{storage.Id, afterId, limit}, callback)
+}
+
+const failureColumns = "f.masterid, coll.collectionid, coll.name, m.signature, f.action, f.param, f.error, f.failures, f.firstfailure, f.lastfailure, f.retryafter"
+
+func scanFailure(mdb *MediaDatabase, row interface{ Scan(...interface{}) error }) (*Failure, error) {
+	failure := &Failure{db: mdb}
+	if err := row.Scan(&failure.MasterId, &failure.CollectionId, &failure.Collection, &failure.Signature, &failure.Action, &failure.Params,
+		&failure.Error, &failure.Failures, &failure.FirstFailure, &failure.LastFailure, &failure.RetryAfter); err != nil {
+		return nil, err
+	}
+	return failure, nil
+}
+
+func (db *PostgresDB) GetFailure(mdb *MediaDatabase, collection, signature, action, paramstr string) (*Failure, error) {
+	sqlstr := fmt.Sprintf("SELECT %s"+
+		" FROM %s.failure AS f, %s.master AS m, %s.collection AS coll"+
+		" WHERE coll.name=$1"+
+		"   AND coll.collectionid=m.collectionid"+
+		"   AND m.signature=$2"+
+		"   AND m.masterid=f.masterid"+
+		"   AND f.action=$3"+
+		"   AND f.param=$4", failureColumns, db.schema, db.schema, db.schema)
+	sqlparams := []interface{}{collection, signature, action, paramstr}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	failure, err := scanFailure(mdb, db.db.QueryRow(sqlstr, sqlparams...))
+	switch err {
+	case nil:
+		return failure, nil
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	default:
+		return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+}
+
+func (db *PostgresDB) GetFailures(mdb *MediaDatabase, collection *Collection, active bool, limit int64, callback func(failure *Failure) error) error {
+	sqlstr := fmt.Sprintf("SELECT %s"+
+		" FROM %s.failure AS f, %s.master AS m, %s.collection AS coll"+
+		" WHERE coll.collectionid=m.collectionid"+
+		"   AND m.masterid=f.masterid"+
+		"   AND ($1=0 OR coll.collectionid=$1)"+
+		"   AND (NOT $2 OR f.retryafter > now())"+
+		" ORDER BY f.lastfailure DESC"+
+		" LIMIT $3", failureColumns, db.schema, db.schema, db.schema)
+	var collectionid int64
+	if collection != nil {
+		collectionid = collection.Id
+	}
+	sqlparams := []interface{}{collectionid, active, limit}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	rows, err := db.db.Query(sqlstr, sqlparams...)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		failure, err := scanFailure(mdb, rows)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot scan result from %s", sqlstr)
+		}
+		if err := callback(failure); err != nil {
+			return emperror.Wrapf(err, "cannot callback for failure of master #%v", failure.MasterId)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return emperror.Wrapf(err, "cannot read result from %s", sqlstr)
+	}
+	return nil
+}
+
+func (db *PostgresDB) StoreFailure(mdb *MediaDatabase, collection, signature, action, paramstr, errstr string, backoff, maxBackoff time.Duration) (*Failure, error) {
+	// the waiting time doubles with every failure
+	sqlstr := fmt.Sprintf("INSERT INTO %s.failure (masterid, action, param, error, retryafter)"+
+		" SELECT m.masterid, $3, $4, $5, now() + make_interval(secs => LEAST($6::float8, $7::float8))"+
+		"   FROM %s.master AS m, %s.collection AS coll"+
+		"   WHERE coll.name=$1 AND coll.collectionid=m.collectionid AND m.signature=$2"+
+		" ON CONFLICT (masterid, action, param) DO UPDATE SET error=EXCLUDED.error, failures=failure.failures+1, lastfailure=now(),"+
+		"   retryafter=now() + make_interval(secs => LEAST($6::float8 * power(2, failure.failures), $7::float8))"+
+		" RETURNING masterid", db.schema, db.schema, db.schema)
+	sqlparams := []interface{}{collection, signature, action, paramstr, errstr, backoff.Seconds(), maxBackoff.Seconds()}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	var masterid int64
+	switch err := db.db.QueryRow(sqlstr, sqlparams...).Scan(&masterid); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	default:
+		return nil, emperror.Wrapf(err, "cannot execute %s - %v", sqlstr, sqlparams)
+	}
+	return db.GetFailure(mdb, collection, signature, action, paramstr)
+}
 
+func (db *PostgresDB) DeleteFailure(mdb *MediaDatabase, masterid int64, action, paramstr string) error {
+	sqlstr := fmt.Sprintf("DELETE FROM %s.failure WHERE masterid=$1 AND action=$2 AND param=$3", db.schema)
+	sqlparams := []interface{}{masterid, action, paramstr}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	if _, err := db.db.Exec(sqlstr, sqlparams...); err != nil {
+		return emperror.Wrapf(err, "%s - %v", sqlstr, sqlparams)
+	}
+	return nil
+}
+
+func (db *PostgresDB) DeleteFailures(mdb *MediaDatabase, master *Master) error {
+	sqlstr := fmt.Sprintf("DELETE FROM %s.failure WHERE masterid=$1", db.schema)
+	sqlparams := []interface{}{master.Id}
+	db.logger.Debugf("SQL: %s - %v", sqlstr, sqlparams)
+	if _, err := db.db.Exec(sqlstr, sqlparams...); err != nil {
+		return emperror.Wrapf(err, "%s - %v", sqlstr, sqlparams)
+	}
+	return nil
 }
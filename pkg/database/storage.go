@@ -30,6 +30,9 @@ func NewStorage(mdb *MediaDatabase, id int64, name, filebase, datadir, videodir,
 	if videodir == "" {
 		videodir = "video"
 	}
+	if submasterdir == "" {
+		submasterdir = "submaster"
+	}
 	if tempdir == "" {
 		tempdir = "temp"
 	}
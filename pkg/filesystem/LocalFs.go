@@ -54,7 +54,14 @@ func (fs *LocalFs) String() string {
 
 func (fs *LocalFs) FileStat(folder, name string, opts FileStatOptions) (os.FileInfo, error) {
 	path := filepath.Join(folder, name)
-	return os.Stat(filepath.Join(fs.basepath, path))
+	info, err := os.Stat(filepath.Join(fs.basepath, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{err: err}
+		}
+		return nil, emperror.Wrapf(err, "cannot get file info for %v", path)
+	}
+	return info, nil
 }
 
 func (fs *LocalFs) FileExists(folder, name string) (bool, error) {
@@ -160,3 +167,27 @@ func (fs *LocalFs) FileOpenRead(folder, name string, opts FileGetOptions) (ReadS
 	}
 	return file, oinfo, nil
 }
+
+func (fs *LocalFs) FileDelete(folder, name string) error {
+	path := filepath.Join(folder, name)
+	if err := os.Remove(filepath.Join(fs.basepath, path)); err != nil {
+		if os.IsNotExist(err) {
+			return &NotFoundError{err: err}
+		}
+		return emperror.Wrapf(err, "cannot delete file %v", path)
+	}
+	return nil
+}
+
+// FileDeleteAll removes the folder prefix with all files
+func (fs *LocalFs) FileDeleteAll(folder, prefix string) error {
+	// never the whole folder
+	if strings.Trim(prefix, "/.") == "" {
+		return fmt.Errorf("invalid prefix %s", prefix)
+	}
+	path := filepath.Join(folder, prefix)
+	if err := os.RemoveAll(filepath.Join(fs.basepath, path)); err != nil {
+		return emperror.Wrapf(err, "cannot delete folder %v", path)
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -183,3 +184,44 @@ func (fs *S3Fs) FileOpenRead(folder, name string, opts FileGetOptions) (ReadSeek
 	finfo := NewS3FileInfo(folder, name, oinfo)
 	return object, finfo, nil
 }
+
+func (fs *S3Fs) FileDelete(folder, name string) error {
+	// removing a non existing object is no error in s3
+	if err := fs.s3.RemoveObject(context.Background(), folder, name, minio.RemoveObjectOptions{}); err != nil {
+		return emperror.Wrapf(err, "cannot delete object %v/%v", folder, name)
+	}
+	return nil
+}
+
+// FileDeleteAll removes all objects, which names start with prefix/
+func (fs *S3Fs) FileDeleteAll(folder, prefix string) error {
+	// never the whole bucket
+	if strings.Trim(prefix, "/.") == "" {
+		return fmt.Errorf("invalid prefix %s", prefix)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := make(chan minio.ObjectInfo)
+	var listErr error
+	go func() {
+		defer close(objects)
+		for object := range fs.s3.ListObjects(ctx, folder, minio.ListObjectsOptions{Prefix: strings.TrimRight(prefix, "/") + "/", Recursive: true}) {
+			if object.Err != nil {
+				listErr = object.Err
+				return
+			}
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for rerr := range fs.s3.RemoveObjects(ctx, folder, objects, minio.RemoveObjectsOptions{}) {
+		return emperror.Wrapf(rerr.Err, "cannot delete object %v/%v", folder, rerr.ObjectName)
+	}
+	if listErr != nil {
+		return emperror.Wrapf(listErr, "cannot list objects %v/%v", folder, prefix)
+	}
+	return nil
+}
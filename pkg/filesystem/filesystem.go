@@ -67,6 +67,8 @@ type FileSystem interface {
 	FileRead(folder, name string, w io.Writer, size int64, opts FileGetOptions) error
 	FileOpenRead(folder, name string, opts FileGetOptions) (ReadSeekerCloser, os.FileInfo, error)
 	FileStat(folder, name string, opts FileStatOptions) (os.FileInfo, error)
+	FileDelete(folder, name string) error
+	FileDeleteAll(folder, prefix string) error
 	String() string
 	Protocol() string
 	IsLocal() bool
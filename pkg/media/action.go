@@ -3,8 +3,11 @@ package media
 import (
 	"errors"
 	"fmt"
+	"github.com/goph/emperror"
 	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
 	"io"
+	"os"
 )
 
 type CoreMeta struct {
@@ -16,6 +19,37 @@ type CoreMeta struct {
 	Size     int64
 }
 
+/*
+ParamError is caused by parameters, which do not fit the action or the master, e.g. a page beyond
+the last one. the request is invalid, not the master
+*/
+type ParamError struct {
+	msg string
+}
+
+func (pe *ParamError) Error() string {
+	return pe.msg
+}
+
+func NewParamError(format string, args ...interface{}) error {
+	return &ParamError{msg: fmt.Sprintf(format, args...)}
+}
+
+// IsParamError looks for a ParamError in the causes of wrapped errors
+func IsParamError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*ParamError); ok {
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
 var ErrInvalidType = errors.New("mediatype: invalid type")
 var ErrInvalidOperation = errors.New("mediatype: invalid operation")
 
@@ -40,3 +74,51 @@ func (ga *GenericAction) Close() {
 func (ga *GenericAction) GetType() string {
 	return "generic"
 }
+
+func writeToStorage(master *database.Master, bucket, path string, reader io.Reader, size int64) error {
+	coll, err := master.GetCollection()
+	if err != nil {
+		return emperror.Wrapf(err, "cannot get collection of %v/%s", master.CollectionId, master.Signature)
+	}
+	stor, err := coll.GetStorage()
+	if err != nil {
+		return emperror.Wrapf(err, "cannot get storage of collection %v", coll.Name)
+	}
+	if err := stor.Fs.FileWrite(bucket, path, reader, size, filesystem.FilePutOptions{}); err != nil {
+		return emperror.Wrapf(err, "cannot write content to %s/%s/%s", stor.Fs.String(), bucket, path)
+	}
+	return nil
+}
+
+// writes a local (temporary) file to the storage of the master
+func writeFileToStorage(master *database.Master, bucket, path string, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot open %s", filename)
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return emperror.Wrapf(err, "cannot stat %s", filename)
+	}
+	return writeToStorage(master, bucket, path, f, finfo.Size())
+}
+
+func buildClipOptions(params map[string]string) (*ClipOptions, error) {
+	var err error
+	clip := &ClipOptions{}
+	if val, ok := params["start"]; ok {
+		if clip.Start, err = ParseTimecode(val); err != nil {
+			return nil, emperror.Wrapf(err, "cannot parse start %s", val)
+		}
+	}
+	if val, ok := params["end"]; ok {
+		if clip.End, err = ParseTimecode(val); err != nil {
+			return nil, emperror.Wrapf(err, "cannot parse end %s", val)
+		}
+		if clip.End <= clip.Start {
+			return nil, fmt.Errorf("end %v before start %v", clip.End, clip.Start)
+		}
+	}
+	return clip, nil
+}
@@ -0,0 +1,111 @@
+package media
+
+import (
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"io"
+	"os"
+)
+
+type AudioAction struct {
+	ff *FFMpeg
+}
+
+type AudioOptions struct {
+	TargetFormat string
+	Clip         *ClipOptions
+	Normalize    *LoudnessTarget
+}
+
+func NewAudioAction(ff *FFMpeg) (*AudioAction, error) {
+	aa := &AudioAction{ff: ff}
+	return aa, nil
+}
+
+func (aa *AudioAction) GetType() string {
+	return "audio"
+}
+
+func (aa *AudioAction) Close() {}
+
+func (aa *AudioAction) buildOptions(params map[string]string) (*AudioOptions, error) {
+	var err error
+	var ao = &AudioOptions{
+		TargetFormat: "mp3",
+	}
+	if ao.Clip, err = buildClipOptions(params); err != nil {
+		return nil, emperror.Wrapf(err, "invalid clip parameters %v", params)
+	}
+	if ao.Normalize, err = aa.ff.buildNormalize(params); err != nil {
+		return nil, emperror.Wrapf(err, "invalid normalize parameter %v", params)
+	}
+	if val, ok := params["format"]; ok {
+		ao.TargetFormat = val
+	}
+	return ao, nil
+}
+
+func (aa *AudioAction) Do(master *database.Master, action string, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	if master.Type != "audio" {
+		return nil, ErrInvalidType
+	}
+	switch action {
+	case "convert":
+	case "waveform":
+		return aa.waveform(master, params, bucket, path, reader)
+	default:
+		return nil, NewParamError("invalid action %s", action)
+	}
+
+	options, err := aa.buildOptions(params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot build options from param %v", params)
+	}
+
+	var outparams = []string{"-vn"}
+	var mimetype string
+	switch options.TargetFormat {
+	case "mp3":
+		mimetype = "audio/mpeg"
+		outparams = append(outparams, "-c:a", "libmp3lame", "-q:a", "2")
+	case "ogg":
+		mimetype = "audio/ogg"
+		outparams = append(outparams, "-c:a", "libvorbis", "-q:a", "5")
+	case "m4a":
+		mimetype = "audio/mp4"
+		outparams = append(outparams, "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart")
+	case "wav":
+		mimetype = "audio/wav"
+		outparams = append(outparams, "-c:a", "pcm_s16le")
+	default:
+		return nil, NewParamError("invalid format %s", options.TargetFormat)
+	}
+
+	filename, cm, err := aa.ff.Convert(reader, options.Clip, options.Normalize, outparams, options.TargetFormat, mimetype)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot convert audio %v/%s", master.CollectionId, master.Signature)
+	}
+	defer os.Remove(filename)
+
+	if err := writeFileToStorage(master, bucket, path, filename); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store audio %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
+
+func (aa *AudioAction) waveform(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	options, err := buildWaveformOptions(params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot build waveform options from param %v", params)
+	}
+	filename, cm, err := aa.ff.Waveform(reader, options)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create waveform of %v/%s", master.CollectionId, master.Signature)
+	}
+	defer os.Remove(filename)
+
+	if err := writeFileToStorage(master, bucket, path, filename); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store waveform %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
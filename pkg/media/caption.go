@@ -0,0 +1,299 @@
+package media
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const captionMaxLength = 256
+
+type CaptionOptions struct {
+	Text         string
+	Field        string
+	Font         string
+	FontSize     float64
+	Color        string
+	Box          string
+	Position     string
+	Width        int64
+	Height       int64
+	TargetFormat string
+}
+
+var captionPositions = map[string]bool{
+	"north": true, "south": true, "east": true, "west": true, "center": true,
+	"northwest": true, "northeast": true, "southwest": true, "southeast": true,
+}
+
+// caption colors are rrggbb, rrggbbaa or none
+func captionColor(str string) (string, error) {
+	if str == "none" {
+		return str, nil
+	}
+	if _, err := parseColor(str); err != nil {
+		return "", err
+	}
+	return "#" + str, nil
+}
+
+/*
+buildCaptionOptions reads the caption parameters. the text is hex encoded utf-8, because parameters are
+not case sensitive. face is the name of a configured font, not a path
+*/
+func buildCaptionOptions(params map[string]string, fonts map[string]string, defaultFont string) (*CaptionOptions, error) {
+	var err error
+	co := &CaptionOptions{
+		Font:         defaultFont,
+		FontSize:     32,
+		Color:        "#ffffff",
+		Box:          "#00000099",
+		Position:     "south",
+		TargetFormat: "png",
+	}
+	for key, val := range params {
+		switch key {
+		case "text":
+			b, err := hex.DecodeString(val)
+			if err != nil {
+				return nil, NewParamError("cannot decode text %s: %v", val, err)
+			}
+			if !utf8.Valid(b) {
+				return nil, NewParamError("text is not utf-8")
+			}
+			co.Text = string(b)
+		case "field":
+			co.Field = val
+		case "face":
+			font, ok := fonts[val]
+			if !ok {
+				return nil, NewParamError("unknown font %s", val)
+			}
+			co.Font = font
+		case "fontsize":
+			if co.FontSize, err = strconv.ParseFloat(val, 64); err != nil {
+				return nil, NewParamError("cannot parse font size %s: %v", val, err)
+			}
+			if !(co.FontSize >= 4 && co.FontSize <= 500) {
+				return nil, NewParamError("font size %s out of range", val)
+			}
+		case "color":
+			if co.Color, err = captionColor(val); err != nil {
+				return nil, err
+			}
+		case "box":
+			if co.Box, err = captionColor(val); err != nil {
+				return nil, err
+			}
+		case "position":
+			if !captionPositions[val] {
+				return nil, NewParamError("invalid position %s", val)
+			}
+			co.Position = val
+		case "size":
+			if co.Width, co.Height, err = parseSize(val); err != nil {
+				return nil, err
+			}
+		case "format":
+			if !pipelineFormats[val] {
+				return nil, NewParamError("invalid format %s", val)
+			}
+			co.TargetFormat = val
+		}
+	}
+	return co, nil
+}
+
+// value of a dot separated path within the master metadata
+func metadataField(metadata interface{}, path string) (string, error) {
+	// metadata of a fresh ingest contains structs
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return "", emperror.Wrap(err, "cannot marshal metadata")
+	}
+	var current interface{}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return "", emperror.Wrap(err, "cannot unmarshal metadata")
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return "", NewParamError("no field %s in metadata", path)
+		}
+		current, ok = m[key]
+		if !ok {
+			// parameters are lowercase, metadata keys not always
+			for k, v := range m {
+				if strings.ToLower(k) == key {
+					current, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return "", NewParamError("no field %s in metadata", path)
+		}
+	}
+	switch val := current.(type) {
+	case string:
+		return val, nil
+	case []interface{}:
+		var parts []string
+		for _, v := range val {
+			parts = append(parts, fmt.Sprintf("%v", v))
+		}
+		return strings.Join(parts, ", "), nil
+	case nil:
+		return "", NewParamError("field %s is empty", path)
+	default:
+		return fmt.Sprintf("%v", val), nil
+	}
+}
+
+// greedy word wrap
+func wrapText(text string, maxWidth float64, width func(string) float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var line string
+		for _, word := range strings.Fields(paragraph) {
+			if line == "" {
+				line = word
+				continue
+			}
+			if width(line+" "+word) > maxWidth {
+				lines = append(lines, line)
+				line = word
+			} else {
+				line += " " + word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (im *ImageMagickV3) drawCaption(dw *imagick.DrawingWand, co *CaptionOptions) error {
+	w, h := float64(im.mw.GetImageWidth()), float64(im.mw.GetImageHeight())
+	padding := math.Round(co.FontSize / 2)
+
+	lines := wrapText(co.Text, w-4*padding, func(str string) float64 {
+		return im.mw.QueryFontMetrics(dw, str).TextWidth
+	})
+	metrics := im.mw.QueryFontMetrics(dw, "Hg")
+	var widths []float64
+	var textWidth float64
+	for _, line := range lines {
+		lw := im.mw.QueryFontMetrics(dw, line).TextWidth
+		widths = append(widths, lw)
+		textWidth = math.Max(textWidth, lw)
+	}
+	boxWidth := textWidth + 2*padding
+	boxHeight := metrics.TextHeight*float64(len(lines)) + 2*padding
+
+	var x, y float64
+	switch {
+	case strings.HasSuffix(co.Position, "west"):
+		x = padding
+	case strings.HasSuffix(co.Position, "east"):
+		x = w - boxWidth - padding
+	default:
+		x = (w - boxWidth) / 2
+	}
+	switch {
+	case strings.HasPrefix(co.Position, "north"):
+		y = padding
+	case strings.HasPrefix(co.Position, "south"):
+		y = h - boxHeight - padding
+	default:
+		y = (h - boxHeight) / 2
+	}
+
+	if co.Box != "none" {
+		bw := imagick.NewDrawingWand()
+		defer bw.Destroy()
+		pw := imagick.NewPixelWand()
+		defer pw.Destroy()
+		pw.SetColor(co.Box)
+		bw.SetFillColor(pw)
+		bw.Rectangle(x, y, x+boxWidth, y+boxHeight)
+		if err := im.mw.DrawImage(bw); err != nil {
+			return emperror.Wrap(err, "cannot draw caption box")
+		}
+	}
+	for i, line := range lines {
+		// annotation position is the baseline, lines are centered
+		lx := x + padding + (textWidth-widths[i])/2
+		ly := y + padding + float64(i)*metrics.TextHeight + metrics.Ascender
+		if err := im.mw.AnnotateImage(dw, lx, ly, 0, line); err != nil {
+			return emperror.Wrapf(err, "cannot annotate %s", line)
+		}
+	}
+	return nil
+}
+
+// Caption renders the text with an optional box onto every frame
+func (im *ImageMagickV3) Caption(co *CaptionOptions) error {
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+	if co.Font != "" {
+		if err := dw.SetFont(co.Font); err != nil {
+			return emperror.Wrapf(err, "cannot set font %s", co.Font)
+		}
+	}
+	dw.SetFontSize(co.FontSize)
+	dw.SetTextEncoding("UTF-8")
+	dw.SetTextAntialias(true)
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor(co.Color)
+	dw.SetFillColor(pw)
+
+	im.mw.ResetIterator()
+	for im.mw.NextImage() {
+		if err := im.drawCaption(dw, co); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shortens caption text to the maximum length
+func captionText(text string) string {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > captionMaxLength {
+		runes := []rune(text)
+		text = string(runes[:captionMaxLength-1]) + "…"
+	}
+	return text
+}
+
+// CaptionField returns the caption text of a metadata field
+func CaptionField(metadata interface{}, field string) (string, error) {
+	text, err := metadataField(metadata, field)
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot get caption from field %s", field)
+	}
+	return captionText(text), nil
+}
+
+// text of the caption from parameter or metadata field
+func (co *CaptionOptions) resolveText(metadata interface{}) error {
+	if co.Text == "" && co.Field != "" {
+		text, err := CaptionField(metadata, co.Field)
+		if err != nil {
+			return err
+		}
+		co.Text = text
+	}
+	co.Text = captionText(co.Text)
+	if co.Text == "" {
+		return fmt.Errorf("no caption text")
+	}
+	return nil
+}
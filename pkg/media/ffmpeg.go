@@ -0,0 +1,241 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	ffmpeg_models "github.com/je4/goffmpeg/models"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FFMpeg struct {
+	ffmpeg     string
+	ffprobe    string
+	tempfolder string
+	timeout    time.Duration
+	loudness   LoudnessTarget
+}
+
+func NewFFMpeg(ffmpeg, ffprobe, tempfolder string, timeout time.Duration, loudness LoudnessTarget) (*FFMpeg, error) {
+	ff := &FFMpeg{
+		ffmpeg:     ffmpeg,
+		ffprobe:    ffprobe,
+		tempfolder: tempfolder,
+		timeout:    timeout,
+		loudness:   loudness,
+	}
+	return ff, nil
+}
+
+/*
+normalize parameter: "normalize" uses the configured loudness target,
+"normalize-16" overrides the integrated loudness target (LUFS)
+*/
+func (ff *FFMpeg) buildNormalize(params map[string]string) (*LoudnessTarget, error) {
+	val, ok := params["normalize"]
+	if !ok {
+		return nil, nil
+	}
+	target := ff.loudness
+	if val != "" {
+		i, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot parse loudness target %s", val)
+		}
+		if i < -70 || i > -5 {
+			return nil, fmt.Errorf("loudness target %v out of range", i)
+		}
+		target.Integrated = i
+	}
+	return &target, nil
+}
+
+type ClipOptions struct {
+	Start, End float64
+}
+
+// ffmpeg parameters to place before (seek) and after (length) the input file
+func (co *ClipOptions) params() (input []string, output []string) {
+	if co.Start > 0 {
+		input = append(input, "-ss", strconv.FormatFloat(co.Start, 'f', -1, 64))
+	}
+	if co.End > 0 {
+		output = append(output, "-t", strconv.FormatFloat(co.End-co.Start, 'f', -1, 64))
+	}
+	return
+}
+
+// writes reader to a local temp file, which is needed for seeking within the master
+func (ff *FFMpeg) tempInput(reader io.Reader) (string, error) {
+	f, err := ioutil.TempFile(ff.tempfolder, "ffmpeg-in-")
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot create temp file in %s", ff.tempfolder)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, reader); err != nil {
+		os.Remove(f.Name())
+		return "", emperror.Wrapf(err, "cannot write temp file %s", f.Name())
+	}
+	return f.Name(), nil
+}
+
+func (ff *FFMpeg) run(cmdparam []string) error {
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), ff.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ff.ffmpeg, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return emperror.Wrapf(err, "error executing (%s %s): %v %v", ff.ffmpeg, cmdparam, out.String(), errb.String())
+	}
+	return nil
+}
+
+func (ff *FFMpeg) probe(filename string) (*ffmpeg_models.Metadata, error) {
+	var ffmeta ffmpeg_models.Metadata
+	cmdparam := []string{
+		"-i", filename,
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-show_error",
+	}
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), ff.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ff.ffprobe, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v %v", ff.ffprobe, cmdparam, out.String(), errb.String())
+	}
+	if err := json.Unmarshal(out.Bytes(), &ffmeta); err != nil {
+		return nil, emperror.Wrapf(err, "cannot unmarshall metadata: %s", out.String())
+	}
+	return &ffmeta, nil
+}
+
+// Convert runs ffmpeg on the content of reader and writes the result to a temp file with extension ext.
+// the caller has to remove the resulting file
+// if normalize is set, a two-pass loudness normalization is applied to the audio stream
+func (ff *FFMpeg) Convert(reader io.Reader, clip *ClipOptions, normalize *LoudnessTarget, outparams []string, ext, mimetype string) (string, *CoreMeta, error) {
+	infile, err := ff.tempInput(reader)
+	if err != nil {
+		return "", nil, emperror.Wrap(err, "cannot create ffmpeg input")
+	}
+	defer os.Remove(infile)
+
+	if normalize != nil {
+		measured, err := AnalyzeLoudness(ff.ffmpeg, infile, clip, normalize, ff.timeout)
+		if err != nil {
+			return "", nil, emperror.Wrap(err, "cannot analyze loudness")
+		}
+		// there is nothing to normalize in silence
+		if !measured.Silent {
+			// loudnorm resamples to 192kHz
+			outparams = append([]string{"-af", normalize.filter(measured), "-ar", "48000"}, outparams...)
+		}
+	}
+
+	outfile := filepath.Join(ff.tempfolder, filepath.Base(infile)+"-out."+ext)
+
+	cmdparam := []string{"-hide_banner", "-nostdin", "-y"}
+	var inclip, outclip []string
+	if clip != nil {
+		inclip, outclip = clip.params()
+	}
+	cmdparam = append(cmdparam, inclip...)
+	cmdparam = append(cmdparam, "-i", infile)
+	cmdparam = append(cmdparam, outclip...)
+	cmdparam = append(cmdparam, outparams...)
+	cmdparam = append(cmdparam, outfile)
+
+	if err := ff.run(cmdparam); err != nil {
+		os.Remove(outfile)
+		return "", nil, emperror.Wrap(err, "cannot convert media")
+	}
+
+	cm, err := ff.coreMeta(outfile, ext, mimetype)
+	if err != nil {
+		os.Remove(outfile)
+		return "", nil, emperror.Wrapf(err, "cannot get metadata of %s", outfile)
+	}
+	return outfile, cm, nil
+}
+
+func (ff *FFMpeg) coreMeta(filename, format, mimetype string) (*CoreMeta, error) {
+	finfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot stat %s", filename)
+	}
+	cm := &CoreMeta{
+		Format:   format,
+		Mimetype: mimetype,
+		Size:     finfo.Size(),
+	}
+	if ff.ffprobe == "" {
+		return cm, nil
+	}
+	ffmeta, err := ff.probe(filename)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot probe %s", filename)
+	}
+	d, _ := strconv.ParseFloat(ffmeta.Format.Duration, 64)
+	cm.Duration = int64(math.Round(d * float64(time.Second)))
+	for _, stream := range ffmeta.Streams {
+		if stream.Width > 0 || stream.Height > 0 {
+			cm.Width = int64(stream.Width)
+			cm.Height = int64(stream.Height)
+		}
+	}
+	return cm, nil
+}
+
+var timecodePart = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ParseTimecode accepts seconds ("90", "90.5", "90s") or clock notation ("1:30", "00:01:30.5")
+func ParseTimecode(str string) (float64, error) {
+	var result float64
+	if len(str) > 0 && str[len(str)-1] == 's' {
+		str = str[:len(str)-1]
+	}
+	parts := strings.Split(str, ":")
+	if len(parts) > 3 {
+		return 0, NewParamError("invalid timecode %s", str)
+	}
+	for i, part := range parts {
+		// ParseFloat would accept signs, exponents, inf and nan
+		if !timecodePart.MatchString(part) {
+			return 0, NewParamError("invalid timecode %s", str)
+		}
+		val, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, emperror.Wrapf(err, "invalid timecode %s", str)
+		}
+		// minutes and seconds of clock notation
+		if i > 0 && val >= 60 {
+			return 0, NewParamError("invalid timecode %s: %s out of range", str, part)
+		}
+		result = result*60 + val
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, NewParamError("invalid timecode %s", str)
+	}
+	// millisecond precision is enough for clipping and keeps the cache key stable
+	return math.Round(result*1000) / 1000, nil
+}
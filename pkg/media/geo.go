@@ -0,0 +1,231 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// GeoInfo is the georeference of a map master. bounds are west, south, east, north in wgs84
+type GeoInfo struct {
+	CRS    string     `json:"crs"`
+	Bounds [4]float64 `json:"bounds"`
+	Width  int64      `json:"width"`
+	Height int64      `json:"height"`
+}
+
+// relevant part of gdalinfo -json
+type gdalInfo struct {
+	Size             []int64 `json:"size"`
+	CoordinateSystem struct {
+		WKT string `json:"wkt"`
+	} `json:"coordinateSystem"`
+	WGS84Extent struct {
+		Coordinates [][][]float64 `json:"coordinates"`
+	} `json:"wgs84Extent"`
+	Stac struct {
+		EPSG int64 `json:"proj:epsg"`
+	} `json:"stac"`
+}
+
+// authority of the whole crs is the last one in the wkt
+var wktEPSGRegexp = regexp.MustCompile(`(?:ID|AUTHORITY)\["EPSG",\s*"?([0-9]+)"?\]\]\s*$`)
+
+func parseGeoInfo(data []byte) (*GeoInfo, error) {
+	var info gdalInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, emperror.Wrap(err, "cannot unmarshal gdalinfo result")
+	}
+	// no georeference
+	if info.CoordinateSystem.WKT == "" || len(info.WGS84Extent.Coordinates) == 0 || len(info.Size) != 2 {
+		return nil, nil
+	}
+	gi := &GeoInfo{
+		CRS:    info.CoordinateSystem.WKT,
+		Bounds: [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)},
+		Width:  info.Size[0],
+		Height: info.Size[1],
+	}
+	if info.Stac.EPSG > 0 {
+		gi.CRS = fmt.Sprintf("EPSG:%d", info.Stac.EPSG)
+	} else if matches := wktEPSGRegexp.FindStringSubmatch(info.CoordinateSystem.WKT); matches != nil {
+		gi.CRS = "EPSG:" + matches[1]
+	}
+	for _, point := range info.WGS84Extent.Coordinates[0] {
+		if len(point) < 2 {
+			continue
+		}
+		gi.Bounds[0] = math.Min(gi.Bounds[0], point[0])
+		gi.Bounds[1] = math.Min(gi.Bounds[1], point[1])
+		gi.Bounds[2] = math.Max(gi.Bounds[2], point[0])
+		gi.Bounds[3] = math.Max(gi.Bounds[3], point[1])
+	}
+	if gi.Bounds[0] > gi.Bounds[2] || gi.Bounds[1] > gi.Bounds[3] {
+		return nil, fmt.Errorf("invalid wgs84 extent")
+	}
+	return gi, nil
+}
+
+// GetGeoInfo reads the georeference of a local file with gdalinfo. it returns nil without georeference
+func GetGeoInfo(gdalinfo, filename string, timeout time.Duration) (*GeoInfo, error) {
+	cmdparam := []string{"-json", filename}
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, gdalinfo, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v", gdalinfo, cmdparam, errb.String())
+	}
+	return parseGeoInfo(out.Bytes())
+}
+
+// MasterGeoInfo extracts the georeference from the metadata of a master
+func MasterGeoInfo(metadata interface{}) (*GeoInfo, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot marshal metadata")
+	}
+	var result struct {
+		Geo *GeoInfo `json:"geo"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, emperror.Wrap(err, "cannot unmarshal metadata")
+	}
+	if result.Geo == nil {
+		return nil, fmt.Errorf("no georeference in metadata")
+	}
+	return result.Geo, nil
+}
+
+// half of the web mercator world width in meters
+const mercatorExtent = 20037508.342789244
+
+func mercator(lon, lat float64) (x, y float64) {
+	lat = math.Max(math.Min(lat, 85.05112878), -85.05112878)
+	x = lon * mercatorExtent / 180
+	y = math.Log(math.Tan((90+lat)*math.Pi/360)) * mercatorExtent / math.Pi
+	return
+}
+
+// MercatorTileBounds returns minx, miny, maxx, maxy of an xyz tile in web mercator
+func MercatorTileBounds(z, x, y int) [4]float64 {
+	size := 2 * mercatorExtent / math.Pow(2, float64(z))
+	return [4]float64{
+		-mercatorExtent + float64(x)*size,
+		mercatorExtent - float64(y+1)*size,
+		-mercatorExtent + float64(x+1)*size,
+		mercatorExtent - float64(y)*size,
+	}
+}
+
+// Intersects checks, whether a tile covers part of the map
+func (gi *GeoInfo) Intersects(z, x, y int) bool {
+	tb := MercatorTileBounds(z, x, y)
+	minx, miny := mercator(gi.Bounds[0], gi.Bounds[1])
+	maxx, maxy := mercator(gi.Bounds[2], gi.Bounds[3])
+	return tb[0] < maxx && tb[2] > minx && tb[1] < maxy && tb[3] > miny
+}
+
+// MaxZoom is the first zoom level, whose tiles have at least the resolution of the map
+func (gi *GeoInfo) MaxZoom(tilesize int64) int {
+	minx, _ := mercator(gi.Bounds[0], 0)
+	maxx, _ := mercator(gi.Bounds[2], 0)
+	if gi.Width <= 0 || maxx <= minx {
+		return 0
+	}
+	resolution := (maxx - minx) / float64(gi.Width)
+	zoom := int(math.Ceil(math.Log2(2 * mercatorExtent / (float64(tilesize) * resolution))))
+	if zoom < 0 {
+		return 0
+	}
+	if zoom > 22 {
+		return 22
+	}
+	return zoom
+}
+
+type GeoWarper struct {
+	gdalwarp   string
+	tempfolder string
+	timeout    time.Duration
+}
+
+func NewGeoWarper(gdalwarp, tempfolder string, timeout time.Duration) (*GeoWarper, error) {
+	gw := &GeoWarper{
+		gdalwarp:   gdalwarp,
+		tempfolder: tempfolder,
+		timeout:    timeout,
+	}
+	return gw, nil
+}
+
+/*
+Tile reprojects the region of an xyz tile from a local georeferenced file to web mercator.
+areas outside of the map are transparent
+*/
+func (gw *GeoWarper) Tile(filename string, z, x, y int, tilesize int64, format string) (io.Reader, *CoreMeta, error) {
+	f, err := ioutil.TempFile(gw.tempfolder, "xyz-*.tif")
+	if err != nil {
+		return nil, nil, emperror.Wrapf(err, "cannot create temp file in %s", gw.tempfolder)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	tb := MercatorTileBounds(z, x, y)
+	cmdparam := []string{
+		"-q", "-overwrite",
+		"-t_srs", "EPSG:3857",
+		"-te", fmt.Sprintf("%f", tb[0]), fmt.Sprintf("%f", tb[1]), fmt.Sprintf("%f", tb[2]), fmt.Sprintf("%f", tb[3]),
+		"-ts", fmt.Sprintf("%d", tilesize), fmt.Sprintf("%d", tilesize),
+		"-r", "bilinear",
+		"-dstalpha",
+		"-of", "GTiff",
+		filename, f.Name(),
+	}
+	var errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), gw.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, gw.gdalwarp, cmdparam...)
+	cmd.Stderr = &errb
+	if err := cmd.Run(); err != nil {
+		return nil, nil, emperror.Wrapf(err, "error executing (%s %s): %v", gw.gdalwarp, cmdparam, errb.String())
+	}
+
+	tile, err := os.Open(f.Name())
+	if err != nil {
+		return nil, nil, emperror.Wrapf(err, "cannot open %s", f.Name())
+	}
+	defer tile.Close()
+	im, err := NewImageMagickV3(tile)
+	if err != nil {
+		return nil, nil, emperror.Wrapf(err, "cannot load warped tile %s", f.Name())
+	}
+	defer im.Close()
+	return im.StoreImage(format)
+}
+
+// EmptyTile is a transparent tile for areas outside of the map
+func EmptyTile(tilesize int64, format string) (io.Reader, *CoreMeta, error) {
+	im := &ImageMagickV3{mw: imagick.NewMagickWand()}
+	defer im.Close()
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor("none")
+	if err := im.mw.NewImage(uint(tilesize), uint(tilesize), pw); err != nil {
+		return nil, nil, emperror.Wrap(err, "cannot create empty tile")
+	}
+	return im.StoreImage(format)
+}
@@ -1,6 +1,7 @@
 package media
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/goph/emperror"
 	"github.com/je4/zmedia/v2/pkg/database"
@@ -11,7 +12,14 @@ import (
 	"strings"
 )
 
-type ImageAction struct{}
+type ImageAction struct {
+	svgDensity float64
+	svgMaxSize int64
+	raw        *RawDecoder
+	overlay    OverlayLoader
+	fonts      map[string]string
+	font       string
+}
 
 func (ia *ImageAction) GetType() string {
 	return "image"
@@ -30,15 +38,42 @@ type ImageOptions struct {
 	TargetFormat                        string
 	OverlayCollection, OverlaySignature string
 	BackgroundColor                     string
+	Density                             float64
 }
 
-func NewImageAction() (*ImageAction, error) {
-	ia := &ImageAction{}
+// default render resolution and maximum edge length of rasterized svg
+const DefaultSVGDensity = 96
+const DefaultSVGMaxSize = 8000
+
+func NewImageAction(svgDensity float64, svgMaxSize int64) (*ImageAction, error) {
+	ia := &ImageAction{
+		svgDensity: svgDensity,
+		svgMaxSize: svgMaxSize,
+	}
 	//	vips.Startup(nil)
 	imagick.Initialize()
 	return ia, nil
 }
 
+// raw masters can only be processed with a decoder
+func (ia *ImageAction) SetRawDecoder(raw *RawDecoder) {
+	ia.raw = raw
+}
+
+// overlays of pipelines are other masters, which are loaded by the media handler
+func (ia *ImageAction) SetOverlayLoader(loader OverlayLoader) {
+	ia.overlay = loader
+}
+
+// fonts for captions by name. the default font is used without face parameter
+func (ia *ImageAction) SetCaptionFonts(fonts map[string]string, defaultFont string) {
+	ia.fonts = make(map[string]string)
+	for name, font := range fonts {
+		ia.fonts[strings.ToLower(name)] = font
+	}
+	ia.font = defaultFont
+}
+
 func (ia *ImageAction) Close() {
 	//	vips.Shutdown()
 	imagick.Terminate()
@@ -96,6 +131,14 @@ func buildOptions(params map[string]string) (*ImageOptions, error) {
 			io.ActionType = val
 		case "format":
 			io.TargetFormat = val
+		case "dpi":
+			if io.Density, err = strconv.ParseFloat(val, 64); err != nil {
+				err = emperror.Wrapf(err, "cannot parse dpi %s", val)
+				return nil, err
+			}
+			if io.Density < 1 || io.Density > 2400 {
+				return nil, NewParamError("invalid dpi %s", val)
+			}
 		case "overlayCollection":
 			io.OverlayCollection = val
 		case "overlaySignature":
@@ -116,12 +159,37 @@ func (ia *ImageAction) Do(master *database.Master, action string, params map[str
 		return nil, ErrInvalidType
 	}
 
+	if action == "master" {
+		return ia.sanitize(master, params, bucket, path, reader)
+	}
+
 	options, err := buildOptions(params)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot build options from param %v", params)
 	}
 
+	if IsRawMimetype(master.Mimetype) {
+		if ia.raw == nil {
+			return nil, fmt.Errorf("no raw decoder for %s", master.Mimetype)
+		}
+		if reader, err = ia.raw.Decode(reader, options.Width, options.Height); err != nil {
+			return nil, emperror.Wrapf(err, "cannot decode raw image %v/%s", master.CollectionId, master.Signature)
+		}
+	}
+
+	switch action {
+	case "pipeline":
+		return ia.pipeline(master, params, bucket, path, reader)
+	case "caption":
+		return ia.caption(master, params, bucket, path, reader)
+	}
+
 	switch master.Mimetype {
+	case "image/svg+xml":
+		if action != "resize" {
+			return nil, NewParamError("invalid action %s", action)
+		}
+		it, err = ia.loadSVG(reader, options)
 	case "image/gif":
 		it, err = NewImageMagickV3(reader)
 	default:
@@ -138,7 +206,7 @@ func (ia *ImageAction) Do(master *database.Master, action string, params map[str
 				it, err = NewImageMagickV3(reader)
 			}
 		default:
-			return nil, fmt.Errorf("invalid action %s", action)
+			return nil, NewParamError("invalid action %s", action)
 		}
 	}
 	if err != nil {
@@ -151,7 +219,7 @@ func (ia *ImageAction) Do(master *database.Master, action string, params map[str
 			return nil, emperror.Wrapf(err, "cannot resize image - %v", params)
 		}
 	default:
-		return nil, fmt.Errorf("invalid action - %s", action)
+		return nil, NewParamError("invalid action - %s", action)
 	}
 
 	reader, cm, err := it.StoreImage(options.TargetFormat)
@@ -173,3 +241,126 @@ func (ia *ImageAction) Do(master *database.Master, action string, params map[str
 
 	return cm, nil
 }
+
+// svg is rasterized by imagemagick. it is sanitized first, to prevent access to external resources
+func (ia *ImageAction) loadSVG(reader io.Reader, options *ImageOptions) (*ImageMagickV3, error) {
+	var buf bytes.Buffer
+	if err := SanitizeSVG(reader, &buf); err != nil {
+		return nil, emperror.Wrap(err, "cannot sanitize svg")
+	}
+	density := options.Density
+	if density == 0 {
+		density = ia.svgDensity
+	}
+	background := options.BackgroundColor
+	if background == "" {
+		// jpeg has no alpha channel
+		if options.TargetFormat == "jpeg" || options.TargetFormat == "jpg" {
+			background = "white"
+		} else {
+			background = "none"
+		}
+	}
+	return NewImageMagickV3Vector(&buf, density, options.Width, options.Height, ia.svgMaxSize, background)
+}
+
+// sanitized passthrough of svg masters, which can be delivered to browsers
+func (ia *ImageAction) sanitize(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	if _, ok := params["sanitize"]; !ok || master.Mimetype != "image/svg+xml" {
+		return nil, NewParamError("sanitize is only possible for svg, not %s", master.Mimetype)
+	}
+	var buf bytes.Buffer
+	if err := SanitizeSVG(reader, &buf); err != nil {
+		return nil, emperror.Wrapf(err, "cannot sanitize svg %v/%s", master.CollectionId, master.Signature)
+	}
+	cm := &CoreMeta{
+		Mimetype: "image/svg+xml",
+		Format:   "svg",
+		Size:     int64(buf.Len()),
+	}
+	if err := writeToStorage(master, bucket, path, &buf, cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store svg %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
+
+// ordered operations are executed by imagemagick
+func (ia *ImageAction) pipeline(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	p, err := ParsePipeline(strings.Split(params["pipeline"], "/"))
+	if err != nil {
+		return nil, emperror.Wrapf(err, "invalid pipeline %s", params["pipeline"])
+	}
+	var im *ImageMagickV3
+	if master.Mimetype == "image/svg+xml" {
+		options := &ImageOptions{TargetFormat: p.Format}
+		if p.Background != "" {
+			options.BackgroundColor = "#" + p.Background
+		}
+		im, err = ia.loadSVG(reader, options)
+	} else {
+		im, err = NewImageMagickV3(reader)
+	}
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create image")
+	}
+	defer im.Close()
+
+	if err := im.Pipeline(p, ia.overlay); err != nil {
+		return nil, emperror.Wrapf(err, "cannot execute pipeline %s", p.String())
+	}
+	result, cm, err := im.StoreImage(p.Format)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot store image %v/%s", master.CollectionId, master.Signature)
+	}
+	if err := writeToStorage(master, bucket, path, result, cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store image %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
+
+// text label on a derivative, rendered by imagemagick
+func (ia *ImageAction) caption(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	co, err := buildCaptionOptions(params, ia.fonts, ia.font)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "invalid caption parameters %v", params)
+	}
+	if err := co.resolveText(master.Metadata); err != nil {
+		return nil, emperror.Wrapf(err, "no caption for %v/%s", master.CollectionId, master.Signature)
+	}
+	options := &ImageOptions{
+		Width:        co.Width,
+		Height:       co.Height,
+		ActionType:   "keep",
+		TargetFormat: co.TargetFormat,
+	}
+	if co.Width > 0 && co.Height > 0 {
+		options.ActionType = "crop"
+	}
+	var im *ImageMagickV3
+	if master.Mimetype == "image/svg+xml" {
+		im, err = ia.loadSVG(reader, options)
+	} else {
+		im, err = NewImageMagickV3(reader)
+	}
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create image")
+	}
+	defer im.Close()
+
+	if co.Width > 0 || co.Height > 0 {
+		if err := im.Resize(options); err != nil {
+			return nil, emperror.Wrapf(err, "cannot resize image - %v", params)
+		}
+	}
+	if err := im.Caption(co); err != nil {
+		return nil, emperror.Wrapf(err, "cannot render caption %s", co.Text)
+	}
+	result, cm, err := im.StoreImage(co.TargetFormat)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot store image %v/%s", master.CollectionId, master.Signature)
+	}
+	if err := writeToStorage(master, bucket, path, result, cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store image %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
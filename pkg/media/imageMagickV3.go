@@ -2,6 +2,7 @@ package media
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/goph/emperror"
 	"gopkg.in/gographics/imagick.v3/imagick"
 	"io"
@@ -21,6 +22,65 @@ func NewImageMagickV3(reader io.Reader) (*ImageMagickV3, error) {
 	return im, nil
 }
 
+/*
+NewImageMagickV3Vector rasterizes a vector image (svg) with a resolution, which is high enough
+for the requested size, so that the result does not need to be upscaled.
+the longer edge of the raster is limited to maxSize
+*/
+func NewImageMagickV3Vector(reader io.Reader, density float64, width, height, maxSize int64, background string) (*ImageMagickV3, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, emperror.Wrapf(err, "cannot read raw image blob")
+	}
+	im := &ImageMagickV3{mw: imagick.NewMagickWand()}
+
+	// intrinsic size at default resolution
+	if err := im.mw.PingImageBlob(buf.Bytes()); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot ping vector image")
+	}
+	base, _, err := im.mw.GetImageResolution()
+	if err != nil || base <= 0 {
+		base = 96
+	}
+	w, h := float64(im.mw.GetImageWidth()), float64(im.mw.GetImageHeight())
+	im.mw.Clear()
+	if w <= 0 || h <= 0 {
+		im.Close()
+		return nil, fmt.Errorf("invalid vector image size %vx%v", w, h)
+	}
+
+	if density <= 0 {
+		density = base
+	}
+	scale := density / base
+	if width > 0 && float64(width) > w*scale {
+		scale = float64(width) / w
+	}
+	if height > 0 && float64(height) > h*scale {
+		scale = float64(height) / h
+	}
+	if maxSize > 0 && math.Max(w, h)*scale > float64(maxSize) {
+		scale = float64(maxSize) / math.Max(w, h)
+	}
+	if err := im.mw.SetResolution(base*scale, base*scale); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot set resolution %v", base*scale)
+	}
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor(background)
+	if err := im.mw.SetBackgroundColor(pw); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot set background color %s", background)
+	}
+	if err := im.mw.ReadImageBlob(buf.Bytes()); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot read vector image from blob")
+	}
+	return im, nil
+}
+
 func (im *ImageMagickV3) Close() {
 	im.mw.Destroy()
 }
@@ -53,7 +113,7 @@ func (im *ImageMagickV3) StoreImage(format string) (io.Reader, *CoreMeta, error)
 		Height:   int64(im.mw.GetImageHeight()),
 		Duration: 0,
 		Format:   im.mw.GetFormat(),
-		Mimetype: "application/octet-stream",
+		Mimetype: imageMimetype(format),
 		Size:     buf.Size(),
 	}
 	return buf, cm, nil
@@ -142,3 +202,162 @@ func (im *ImageMagickV3) Resize(options *ImageOptions) error {
 	}
 	return nil
 }
+
+func imageMimetype(format string) string {
+	switch format {
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	case "png", "webp", "gif", "tiff":
+		return "image/" + format
+	case "ptiff":
+		return "image/tiff"
+	case "jpeg2000", "jp2":
+		return "image/jp2"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// OverlayLoader opens another image, which is used as overlay. the loader checks type and size
+type OverlayLoader func(collection, signature string) (io.ReadCloser, error)
+
+func (im *ImageMagickV3) loadOverlay(op *PipelineOp, loader OverlayLoader) (*imagick.MagickWand, error) {
+	if loader == nil {
+		return nil, fmt.Errorf("no overlay loader")
+	}
+	reader, err := loader(op.Collection, op.Signature)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot open overlay %s/%s", op.Collection, op.Signature)
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, emperror.Wrapf(err, "cannot read overlay %s/%s", op.Collection, op.Signature)
+	}
+	ov := imagick.NewMagickWand()
+	if err := ov.ReadImageBlob(buf.Bytes()); err != nil {
+		ov.Destroy()
+		return nil, emperror.Wrapf(err, "cannot read overlay image %s/%s", op.Collection, op.Signature)
+	}
+	return ov, nil
+}
+
+func (im *ImageMagickV3) applyOp(op *PipelineOp, background *imagick.PixelWand, overlay *imagick.MagickWand) error {
+	mw := im.mw
+	switch op.Name {
+	case "resize", "stretch":
+		w, h := op.Width, op.Height
+		if op.Name == "resize" {
+			if w == 0 {
+				w = math.MaxInt32
+			}
+			if h == 0 {
+				h = math.MaxInt32
+			}
+			w, h = CalcSizeMin(int64(mw.GetImageWidth()), int64(mw.GetImageHeight()), w, h)
+		}
+		if err := mw.ResizeImage(uint(w), uint(h), imagick.FILTER_LANCZOS); err != nil {
+			return emperror.Wrapf(err, "cannot resizeimage(%v, %v)", w, h)
+		}
+	case "crop":
+		x, y := op.X, op.Y
+		width, height := int64(mw.GetImageWidth()), int64(mw.GetImageHeight())
+		if !op.Offset {
+			x = (width - op.Width) / 2
+			y = (height - op.Height) / 2
+			// regions larger than the image keep the whole side
+			if x < 0 {
+				x = 0
+			}
+			if y < 0 {
+				y = 0
+			}
+		}
+		if x >= width || y >= height {
+			return NewParamError("crop region %vx%v+%v+%v is outside of the image %vx%v", op.Width, op.Height, x, y, width, height)
+		}
+		if err := mw.CropImage(uint(op.Width), uint(op.Height), int(x), int(y)); err != nil {
+			return emperror.Wrapf(err, "cannot cropimage(%v, %v, %v, %v)", op.Width, op.Height, x, y)
+		}
+		// remove virtual canvas of the region
+		if err := mw.ResetImagePage(""); err != nil {
+			return emperror.Wrap(err, "cannot reset page")
+		}
+	case "rotate":
+		if err := mw.RotateImage(background, op.Value); err != nil {
+			return emperror.Wrapf(err, "cannot rotateimage(%v)", op.Value)
+		}
+		if err := mw.ResetImagePage(""); err != nil {
+			return emperror.Wrap(err, "cannot reset page")
+		}
+	case "flip":
+		if err := mw.FlipImage(); err != nil {
+			return emperror.Wrap(err, "cannot flipimage")
+		}
+	case "flop":
+		if err := mw.FlopImage(); err != nil {
+			return emperror.Wrap(err, "cannot flopimage")
+		}
+	case "grayscale":
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+			return emperror.Wrap(err, "cannot transform to grayscale")
+		}
+	case "blur":
+		if err := mw.BlurImage(0, op.Value); err != nil {
+			return emperror.Wrapf(err, "cannot blurimage(0, %v)", op.Value)
+		}
+	case "sharpen":
+		if err := mw.SharpenImage(0, op.Value); err != nil {
+			return emperror.Wrapf(err, "cannot sharpenimage(0, %v)", op.Value)
+		}
+	case "overlay":
+		if err := mw.CompositeImageGravity(overlay, imagick.COMPOSITE_OP_OVER, imagick.GRAVITY_CENTER); err != nil {
+			return emperror.Wrap(err, "cannot composite overlay")
+		}
+	default:
+		return NewParamError("invalid operation %s", op.Name)
+	}
+	return nil
+}
+
+// Pipeline applies the operations in order to every frame of the image
+func (im *ImageMagickV3) Pipeline(p *Pipeline, loader OverlayLoader) error {
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if p.Background != "" {
+		background.SetColor("#" + p.Background)
+	} else {
+		background.SetColor("none")
+	}
+
+	im.mw.ResetIterator()
+	for im.mw.NextImage() {
+		if err := im.mw.AutoOrientImage(); err != nil {
+			return emperror.Wrapf(err, "cannot auto orient image")
+		}
+	}
+	for _, op := range p.Ops {
+		var overlay *imagick.MagickWand
+		if op.Name == "overlay" {
+			var err error
+			if overlay, err = im.loadOverlay(op, loader); err != nil {
+				return err
+			}
+		}
+		im.mw.ResetIterator()
+		im.frames = 0
+		for im.mw.NextImage() {
+			im.frames++
+			if err := im.applyOp(op, background, overlay); err != nil {
+				if overlay != nil {
+					overlay.Destroy()
+				}
+				return emperror.Wrapf(err, "cannot apply %s", op.String())
+			}
+		}
+		if overlay != nil {
+			overlay.Destroy()
+		}
+	}
+	return nil
+}
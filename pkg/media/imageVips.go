@@ -2,7 +2,6 @@ package media
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/goph/emperror"
 	"io"
@@ -100,7 +99,7 @@ func (it *ImageVips) StoreImage(format string) (io.Reader, *CoreMeta, error) {
 		ep = vips.NewDefaultWEBPExportParams()
 		mimetype = "image/webp"
 	default:
-		return nil, nil, fmt.Errorf("invalid format %s", format)
+		return nil, nil, NewParamError("invalid format %s", format)
 	}
 	b, meta, err := it.image.Export(ep)
 	if err != nil {
@@ -0,0 +1,120 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"math"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// EBU R128 measurement of an audio stream
+type Loudness struct {
+	Integrated float64 `json:"integrated"` // LUFS
+	TruePeak   float64 `json:"truepeak"`   // dBTP
+	LRA        float64 `json:"lra"`        // LU
+	Threshold  float64 `json:"threshold"`  // LUFS
+	Offset     float64 `json:"-"`          // gain offset for the second pass, depends on target
+	Silent     bool    `json:"silent,omitempty"`
+}
+
+type LoudnessTarget struct {
+	Integrated float64
+	TruePeak   float64
+	LRA        float64
+}
+
+var DefaultLoudnessTarget = LoudnessTarget{
+	Integrated: -23,
+	TruePeak:   -1,
+	LRA:        7,
+}
+
+// result of the loudnorm filter with print_format=json
+type loudnormResult struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+func (lt *LoudnessTarget) params() string {
+	return fmt.Sprintf("I=%s:TP=%s:LRA=%s",
+		strconv.FormatFloat(lt.Integrated, 'f', -1, 64),
+		strconv.FormatFloat(lt.TruePeak, 'f', -1, 64),
+		strconv.FormatFloat(lt.LRA, 'f', -1, 64))
+}
+
+// loudnorm filter for the second pass based on the measurement of the first pass
+func (lt *LoudnessTarget) filter(measured *Loudness) string {
+	return fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		lt.params(),
+		strconv.FormatFloat(measured.Integrated, 'f', 2, 64),
+		strconv.FormatFloat(measured.TruePeak, 'f', 2, 64),
+		strconv.FormatFloat(measured.LRA, 'f', 2, 64),
+		strconv.FormatFloat(measured.Threshold, 'f', 2, 64),
+		strconv.FormatFloat(measured.Offset, 'f', 2, 64))
+}
+
+/*
+AnalyzeLoudness runs the first pass of the ffmpeg loudnorm filter on input, which could be a local file or an url.
+The measured values do not depend on target, only the offset does.
+*/
+func AnalyzeLoudness(ffmpeg, input string, clip *ClipOptions, target *LoudnessTarget, timeout time.Duration) (*Loudness, error) {
+	if target == nil {
+		target = &DefaultLoudnessTarget
+	}
+	cmdparam := []string{"-hide_banner", "-nostdin"}
+	var inclip, outclip []string
+	if clip != nil {
+		inclip, outclip = clip.params()
+	}
+	cmdparam = append(cmdparam, inclip...)
+	cmdparam = append(cmdparam, "-i", input)
+	cmdparam = append(cmdparam, outclip...)
+	cmdparam = append(cmdparam, "-vn", "-af", "loudnorm="+target.params()+":print_format=json", "-f", "null", "-")
+
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpeg, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v %v", ffmpeg, cmdparam, out.String(), errb.String())
+	}
+
+	// the json result is the last block in the log output
+	stderr := errb.Bytes()
+	start := bytes.LastIndexByte(stderr, '{')
+	end := bytes.LastIndexByte(stderr, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no loudnorm result in ffmpeg output: %s", errb.String())
+	}
+	var lr loudnormResult
+	if err := json.Unmarshal(stderr[start:end+1], &lr); err != nil {
+		return nil, emperror.Wrapf(err, "cannot unmarshal loudnorm result %s", string(stderr[start:end+1]))
+	}
+
+	l := &Loudness{}
+	strs := []string{lr.InputI, lr.InputTP, lr.InputLRA, lr.InputThresh, lr.TargetOffset}
+	vals := []*float64{&l.Integrated, &l.TruePeak, &l.LRA, &l.Threshold, &l.Offset}
+	for i, str := range strs {
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot parse loudnorm value %s", str)
+		}
+		// silence results in -inf, which cannot be stored as json
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return &Loudness{Silent: true}, nil
+		}
+		*vals[i] = f
+	}
+	return l, nil
+}
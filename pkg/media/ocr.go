@@ -0,0 +1,228 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default render resolution of pdf pages and maximum number of pages for text recognition
+const DefaultOCRDensity = 300
+const DefaultOCRMaxPages = 500
+
+// output formats of tesseract with their config name and mimetype
+var ocrFormats = map[string][2]string{
+	"txt":  {"", "text/plain"},
+	"hocr": {"hocr", "text/html"},
+	"alto": {"alto", "application/xml"},
+}
+
+/*
+OCR is the action for text recognition with tesseract. it is not bound to a master type,
+images and pdf documents are accepted
+*/
+type OCR struct {
+	tesseract  string
+	tempfolder string
+	languages  string
+	density    float64
+	maxPages   int
+	timeout    time.Duration
+}
+
+func NewOCR(tesseract, tempfolder, languages string, density float64, maxPages int, timeout time.Duration) (*OCR, error) {
+	o := &OCR{
+		tesseract:  tesseract,
+		tempfolder: tempfolder,
+		languages:  languages,
+		density:    density,
+		maxPages:   maxPages,
+		timeout:    timeout,
+	}
+	return o, nil
+}
+
+func (o *OCR) GetType() string {
+	return "ocr"
+}
+
+func (o *OCR) Close() {}
+
+// Supports checks, whether text can be recognized in masters of mimetype
+func (o *OCR) Supports(mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	if mimetype == "application/pdf" {
+		return true
+	}
+	return strings.HasPrefix(mimetype, "image/") && mimetype != "image/svg+xml" && !IsRawMimetype(mimetype)
+}
+
+/*
+pages writes the pages of a document as images into folder. page 0 means all pages.
+images are used directly, multi page tiffs are handled by tesseract
+*/
+func (o *OCR) pages(folder string, reader io.Reader, mimetype string, page int) ([]string, error) {
+	f, err := ioutil.TempFile(folder, "master-")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create temp file in %s", folder)
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return nil, emperror.Wrapf(err, "cannot write temp file %s", f.Name())
+	}
+	f.Close()
+	if strings.ToLower(mimetype) != "application/pdf" {
+		if page > 1 {
+			return nil, NewParamError("image has no page %v", page)
+		}
+		return []string{f.Name()}, nil
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.PingImage(f.Name()); err != nil {
+		return nil, emperror.Wrapf(err, "cannot ping pdf %s", f.Name())
+	}
+	num := int(mw.GetNumberImages())
+	first, last := 1, num
+	if page > 0 {
+		if page > num {
+			return nil, NewParamError("pdf has no page %v", page)
+		}
+		first, last = page, page
+	}
+	if last-first+1 > o.maxPages {
+		return nil, fmt.Errorf("pdf has more than %v pages", o.maxPages)
+	}
+	var files []string
+	for p := first; p <= last; p++ {
+		pageName := filepath.Join(folder, fmt.Sprintf("page-%05d.png", p))
+		if err := o.renderPage(f.Name(), p, pageName); err != nil {
+			return nil, err
+		}
+		files = append(files, pageName)
+	}
+	return files, nil
+}
+
+func (o *OCR) renderPage(filename string, page int, target string) error {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.SetResolution(o.density, o.density); err != nil {
+		return emperror.Wrapf(err, "cannot set resolution %v", o.density)
+	}
+	if err := mw.ReadImage(fmt.Sprintf("%s[%d]", filename, page-1)); err != nil {
+		return emperror.Wrapf(err, "cannot render page %v", page)
+	}
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor("white")
+	mw.SetImageBackgroundColor(pw)
+	if err := mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE); err != nil {
+		return emperror.Wrapf(err, "cannot remove alpha channel of page %v", page)
+	}
+	if err := mw.SetImageFormat("png"); err != nil {
+		return emperror.Wrap(err, "cannot set format png")
+	}
+	if err := mw.WriteImage(target); err != nil {
+		return emperror.Wrapf(err, "cannot write page %v to %s", page, target)
+	}
+	return nil
+}
+
+// Recognize runs tesseract on the pages of a document. several pages result in one output document
+func (o *OCR) Recognize(reader io.Reader, mimetype, format string, page int) ([]byte, error) {
+	ocrFormat, ok := ocrFormats[format]
+	if !ok {
+		return nil, NewParamError("invalid ocr format %s", format)
+	}
+	folder, err := ioutil.TempDir(o.tempfolder, "ocr-")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create temp folder in %s", o.tempfolder)
+	}
+	defer os.RemoveAll(folder)
+
+	files, err := o.pages(folder, reader, mimetype, page)
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot extract pages")
+	}
+	input := files[0]
+	if len(files) > 1 {
+		// tesseract reads a list of images from a text file
+		input = filepath.Join(folder, "pages.txt")
+		if err := ioutil.WriteFile(input, []byte(strings.Join(files, "\n")+"\n"), 0600); err != nil {
+			return nil, emperror.Wrapf(err, "cannot write page list %s", input)
+		}
+	}
+
+	cmdparam := []string{input, "stdout"}
+	if o.languages != "" {
+		cmdparam = append(cmdparam, "-l", o.languages)
+	}
+	if ocrFormat[0] != "" {
+		cmdparam = append(cmdparam, ocrFormat[0])
+	}
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, o.tesseract, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v", o.tesseract, cmdparam, errb.String())
+	}
+	return out.Bytes(), nil
+}
+
+/*
+Do creates text (txt), hocr or alto from the master. without page parameter all pages of a pdf
+are recognized
+*/
+func (o *OCR) Do(master *database.Master, action string, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	if action != "ocr" {
+		return nil, NewParamError("invalid action %s", action)
+	}
+	if !o.Supports(master.Mimetype) {
+		return nil, ErrInvalidType
+	}
+	format := "txt"
+	if val, ok := params["format"]; ok {
+		format = val
+	}
+	var page int
+	if val, ok := params["page"]; ok {
+		var err error
+		if page, err = strconv.Atoi(val); err != nil || page < 1 {
+			return nil, NewParamError("invalid page %s", val)
+		}
+	}
+	if _, ok := ocrFormats[format]; !ok {
+		return nil, NewParamError("invalid ocr format %s", format)
+	}
+
+	result, err := o.Recognize(reader, master.Mimetype, format, page)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot recognize text of %v/%s", master.CollectionId, master.Signature)
+	}
+	cm := &CoreMeta{
+		Mimetype: ocrFormats[format][1],
+		Format:   format,
+		Size:     int64(len(result)),
+	}
+	if err := writeToStorage(master, bucket, path, bytes.NewReader(result), cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store ocr result of %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
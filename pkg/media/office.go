@@ -0,0 +1,149 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mimetypes, which are converted by libreoffice
+var officeMimetypes = map[string]bool{
+	"application/msword":            true,
+	"application/rtf":               true,
+	"text/rtf":                      true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/vnd.visio":         true,
+}
+
+var officeMimePrefixes = []string{
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+	"application/vnd.ms-word.",
+	"application/vnd.ms-excel.",
+	"application/vnd.ms-powerpoint.",
+}
+
+func IsOfficeMimetype(mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	if officeMimetypes[mimetype] {
+		return true
+	}
+	for _, prefix := range officeMimePrefixes {
+		if strings.HasPrefix(mimetype, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+OfficeAction converts office documents to pdf with a headless libreoffice.
+pages are rendered from the converted pdf, which is provided by the media handler
+*/
+type OfficeAction struct {
+	soffice    string
+	tempfolder string
+	timeout    time.Duration
+	pdf        *PDFAction
+}
+
+func NewOfficeAction(soffice, tempfolder string, timeout time.Duration, pdf *PDFAction) (*OfficeAction, error) {
+	oa := &OfficeAction{
+		soffice:    soffice,
+		tempfolder: tempfolder,
+		timeout:    timeout,
+		pdf:        pdf,
+	}
+	return oa, nil
+}
+
+func (oa *OfficeAction) GetType() string {
+	return "office"
+}
+
+func (oa *OfficeAction) Close() {}
+
+func (oa *OfficeAction) Do(master *database.Master, action string, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	switch action {
+	case "pdf":
+		return oa.convert(master, bucket, path, reader)
+	case "page":
+		// reader is the pdf conversion
+		return oa.pdf.page(master, params, bucket, path, reader)
+	default:
+		return nil, NewParamError("invalid action %s", action)
+	}
+}
+
+/*
+ToPDF converts a document with soffice. ext is the extension of the original file, which is needed
+for the detection of the import filter. every conversion uses its own profile, so that several
+instances can run at the same time
+*/
+func (oa *OfficeAction) ToPDF(reader io.Reader, ext string) ([]byte, error) {
+	folder, err := ioutil.TempDir(oa.tempfolder, "office-")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create temp folder in %s", oa.tempfolder)
+	}
+	defer os.RemoveAll(folder)
+
+	input := filepath.Join(folder, "document"+strings.ToLower(ext))
+	f, err := os.Create(input)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create %s", input)
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return nil, emperror.Wrapf(err, "cannot write %s", input)
+	}
+	f.Close()
+
+	outdir := filepath.Join(folder, "out")
+	cmdparam := []string{
+		"--headless", "--norestore", "--nolockcheck",
+		"-env:UserInstallation=file://" + filepath.ToSlash(filepath.Join(folder, "profile")),
+		"--convert-to", "pdf",
+		"--outdir", outdir,
+		input,
+	}
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), oa.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, oa.soffice, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v %v", oa.soffice, cmdparam, out.String(), errb.String())
+	}
+	// soffice does not fail, if the document cannot be converted
+	data, err := ioutil.ReadFile(filepath.Join(outdir, "document.pdf"))
+	if err != nil {
+		return nil, emperror.Wrapf(err, "no pdf created: %v %v", out.String(), errb.String())
+	}
+	return data, nil
+}
+
+func (oa *OfficeAction) convert(master *database.Master, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	data, err := oa.ToPDF(reader, filepath.Ext(master.Urn))
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot convert %v/%s to pdf", master.CollectionId, master.Signature)
+	}
+	cm := &CoreMeta{
+		Mimetype: "application/pdf",
+		Format:   "pdf",
+		Size:     int64(len(data)),
+	}
+	if err := writeToStorage(master, bucket, path, bytes.NewReader(data), cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store pdf of %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
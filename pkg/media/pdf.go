@@ -0,0 +1,125 @@
+package media
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// default render resolution of pdf pages
+const DefaultPDFDensity = 150
+
+// PDFAction renders pages of pdf masters
+type PDFAction struct {
+	density    float64
+	tempfolder string
+}
+
+func NewPDFAction(density float64, tempfolder string) (*PDFAction, error) {
+	pa := &PDFAction{
+		density:    density,
+		tempfolder: tempfolder,
+	}
+	return pa, nil
+}
+
+func (pa *PDFAction) GetType() string {
+	return "pdf"
+}
+
+func (pa *PDFAction) Close() {}
+
+func (pa *PDFAction) Do(master *database.Master, action string, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	switch action {
+	case "page":
+		return pa.page(master, params, bucket, path, reader)
+	default:
+		return nil, NewParamError("invalid action %s", action)
+	}
+}
+
+/*
+loadPage rasterizes one page (starting with 1) of a pdf with ghostscript.
+transparent areas become white
+*/
+func (pa *PDFAction) loadPage(reader io.Reader, page int, density float64) (*ImageMagickV3, error) {
+	f, err := ioutil.TempFile(pa.tempfolder, "pdf-")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create temp file in %s", pa.tempfolder)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return nil, emperror.Wrapf(err, "cannot write temp file %s", f.Name())
+	}
+	f.Close()
+
+	im := &ImageMagickV3{mw: imagick.NewMagickWand()}
+	if err := im.mw.PingImage(f.Name()); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot ping pdf %s", f.Name())
+	}
+	if pages := int(im.mw.GetNumberImages()); page > pages {
+		im.Close()
+		return nil, NewParamError("pdf has no page %v of %v", page, pages)
+	}
+	im.mw.Clear()
+	if err := im.mw.SetResolution(density, density); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot set resolution %v", density)
+	}
+	if err := im.mw.ReadImage(fmt.Sprintf("%s[%d]", f.Name(), page-1)); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot render page %v", page)
+	}
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor("white")
+	im.mw.SetImageBackgroundColor(pw)
+	if err := im.mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE); err != nil {
+		im.Close()
+		return nil, emperror.Wrapf(err, "cannot remove alpha channel of page %v", page)
+	}
+	return im, nil
+}
+
+// page renders a pdf page with the resize parameters size, format and dpi
+func (pa *PDFAction) page(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	options, err := buildOptions(params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot build options from param %v", params)
+	}
+	page := 1
+	if val, ok := params["page"]; ok {
+		if page, err = strconv.Atoi(val); err != nil || page < 1 {
+			return nil, NewParamError("invalid page %s", val)
+		}
+	}
+	density := options.Density
+	if density == 0 {
+		density = pa.density
+	}
+	im, err := pa.loadPage(reader, page, density)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot load page %v of %v/%s", page, master.CollectionId, master.Signature)
+	}
+	defer im.Close()
+	if options.Width > 0 || options.Height > 0 {
+		if err := im.Resize(options); err != nil {
+			return nil, emperror.Wrapf(err, "cannot resize page - %v", params)
+		}
+	}
+	result, cm, err := im.StoreImage(options.TargetFormat)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot store page %v of %v/%s", page, master.CollectionId, master.Signature)
+	}
+	if err := writeToStorage(master, bucket, path, result, cm.Size); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store page %v of %v/%s", page, master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
@@ -0,0 +1,235 @@
+package media
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Pipeline is an ordered list of image operations. Every path segment is one operation,
+which is applied to the result of the previous one:
+
+	resize<w>x<h>          fit into box, keeping aspect ratio (w or h may be empty)
+	stretch<w>x<h>         scale to exact size
+	crop<w>x<h>[+<x>+<y>]  cut region, centered without offset
+	rotate<degrees>        clockwise, uncovered areas get the background color
+	flip, flop             mirror vertically, horizontally
+	grayscale
+	blur<sigma>, sharpen<sigma>
+	overlay<collection>-<signature>  composite another master centered on top
+
+background<color> and format<format> are options of the whole pipeline and not ordered.
+*/
+type Pipeline struct {
+	Ops        []*PipelineOp
+	Background string
+	Format     string
+}
+
+type PipelineOp struct {
+	Name                  string
+	Width, Height         int64
+	X, Y                  int64
+	Offset                bool
+	Value                 float64
+	Collection, Signature string
+}
+
+const pipelineMaxOps = 20
+const pipelineMaxSize = 20000
+
+var pipelineOpRegexp = regexp.MustCompile(`^(resize|stretch|crop|rotate|flip|flop|grayscale|blur|sharpen|overlay|background|format)(.*)$`)
+var pipelineSizeRegexp = regexp.MustCompile(`^([0-9]*)x([0-9]*)$`)
+var pipelineCropRegexp = regexp.MustCompile(`^([0-9]+)x([0-9]+)(\+([0-9]+)\+([0-9]+))?$`)
+var pipelineOverlayRegexp = regexp.MustCompile(`^([^-]+)-(.+)$`)
+var pipelineColorRegexp = regexp.MustCompile(`^(none|[0-9a-f]{6}|[0-9a-f]{8})$`)
+
+var pipelineFormats = map[string]bool{
+	"png":  true,
+	"jpeg": true,
+	"webp": true,
+	"gif":  true,
+	"tiff": true,
+}
+
+// PipelineOpName returns the operation name of a path segment
+func PipelineOpName(segment string) string {
+	matches := pipelineOpRegexp.FindStringSubmatch(strings.ToLower(segment))
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func parseSize(str string) (width, height int64, err error) {
+	matches := pipelineSizeRegexp.FindStringSubmatch(str)
+	if matches == nil {
+		return 0, 0, NewParamError("invalid size %s", str)
+	}
+	if matches[1] != "" {
+		width, _ = strconv.ParseInt(matches[1], 10, 64)
+	}
+	if matches[2] != "" {
+		height, _ = strconv.ParseInt(matches[2], 10, 64)
+	}
+	if width > pipelineMaxSize || height > pipelineMaxSize {
+		return 0, 0, NewParamError("size %s too large", str)
+	}
+	return
+}
+
+func parsePipelineOp(name, args string) (*PipelineOp, error) {
+	var err error
+	op := &PipelineOp{Name: name}
+	switch name {
+	case "resize", "stretch":
+		if op.Width, op.Height, err = parseSize(args); err != nil {
+			return nil, err
+		}
+		if op.Width == 0 && op.Height == 0 {
+			return nil, NewParamError("%s needs width or height", name)
+		}
+		if name == "stretch" && (op.Width == 0 || op.Height == 0) {
+			return nil, NewParamError("stretch needs width and height")
+		}
+	case "crop":
+		matches := pipelineCropRegexp.FindStringSubmatch(args)
+		if matches == nil {
+			return nil, NewParamError("invalid crop %s", args)
+		}
+		op.Width, _ = strconv.ParseInt(matches[1], 10, 64)
+		op.Height, _ = strconv.ParseInt(matches[2], 10, 64)
+		if matches[3] != "" {
+			op.Offset = true
+			op.X, _ = strconv.ParseInt(matches[4], 10, 64)
+			op.Y, _ = strconv.ParseInt(matches[5], 10, 64)
+		}
+		if op.Width == 0 || op.Height == 0 || op.Width > pipelineMaxSize || op.Height > pipelineMaxSize {
+			return nil, NewParamError("invalid crop size %s", args)
+		}
+	case "rotate":
+		if op.Value, err = strconv.ParseFloat(args, 64); err != nil {
+			return nil, NewParamError("invalid rotation %s", args)
+		}
+		if math.IsNaN(op.Value) || math.IsInf(op.Value, 0) {
+			return nil, NewParamError("invalid rotation %s", args)
+		}
+		op.Value = math.Mod(op.Value, 360)
+		if op.Value < 0 {
+			op.Value += 360
+		}
+	case "blur", "sharpen":
+		if op.Value, err = strconv.ParseFloat(args, 64); err != nil {
+			return nil, NewParamError("invalid sigma %s", args)
+		}
+		if !(op.Value > 0 && op.Value <= 100) {
+			return nil, NewParamError("sigma %s out of range", args)
+		}
+	case "flip", "flop", "grayscale":
+		if args != "" {
+			return nil, NewParamError("%s has no arguments", name)
+		}
+	case "overlay":
+		matches := pipelineOverlayRegexp.FindStringSubmatch(args)
+		if matches == nil {
+			return nil, NewParamError("invalid overlay %s", args)
+		}
+		op.Collection, op.Signature = matches[1], matches[2]
+	default:
+		return nil, NewParamError("invalid operation %s", name)
+	}
+	return op, nil
+}
+
+// ParsePipeline validates the path segments. empty segments are ignored
+func ParsePipeline(segments []string) (*Pipeline, error) {
+	p := &Pipeline{Format: "png"}
+	for _, segment := range segments {
+		segment = strings.ToLower(segment)
+		if segment == "" {
+			continue
+		}
+		matches := pipelineOpRegexp.FindStringSubmatch(segment)
+		if matches == nil {
+			return nil, NewParamError("unknown operation %s", segment)
+		}
+		switch matches[1] {
+		case "format":
+			if !pipelineFormats[matches[2]] {
+				return nil, NewParamError("invalid format %s", matches[2])
+			}
+			p.Format = matches[2]
+		case "background":
+			if !pipelineColorRegexp.MatchString(matches[2]) {
+				return nil, NewParamError("invalid background %s", matches[2])
+			}
+			// transparent is the default
+			if matches[2] != "none" {
+				p.Background = matches[2]
+			}
+		default:
+			op, err := parsePipelineOp(matches[1], matches[2])
+			if err != nil {
+				return nil, emperror.Wrapf(err, "invalid operation %s", segment)
+			}
+			// no-op
+			if op.Name == "rotate" && op.Value == 0 {
+				continue
+			}
+			p.Ops = append(p.Ops, op)
+		}
+	}
+	if len(p.Ops) == 0 {
+		return nil, NewParamError("empty pipeline")
+	}
+	if len(p.Ops) > pipelineMaxOps {
+		return nil, NewParamError("more than %v operations", pipelineMaxOps)
+	}
+	return p, nil
+}
+
+func (op *PipelineOp) String() string {
+	switch op.Name {
+	case "resize", "stretch":
+		var w, h string
+		if op.Width > 0 {
+			w = strconv.FormatInt(op.Width, 10)
+		}
+		if op.Height > 0 {
+			h = strconv.FormatInt(op.Height, 10)
+		}
+		return fmt.Sprintf("%s%sx%s", op.Name, w, h)
+	case "crop":
+		if op.Offset {
+			return fmt.Sprintf("crop%dx%d+%d+%d", op.Width, op.Height, op.X, op.Y)
+		}
+		return fmt.Sprintf("crop%dx%d", op.Width, op.Height)
+	case "rotate", "blur", "sharpen":
+		return op.Name + formatFloat(op.Value)
+	case "overlay":
+		return fmt.Sprintf("overlay%s-%s", op.Collection, op.Signature)
+	default:
+		return op.Name
+	}
+}
+
+// String is the canonical form of the pipeline, which is used as cache key
+func (p *Pipeline) String() string {
+	var parts []string
+	for _, op := range p.Ops {
+		parts = append(parts, op.String())
+	}
+	if p.Background != "" {
+		parts = append(parts, "background"+p.Background)
+	}
+	parts = append(parts, "format"+p.Format)
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,113 @@
+package media
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	// equivalent pipelines result in the same cache key
+	tests := []struct {
+		name     string
+		segments []string
+		result   string
+	}{
+		{
+			name:     "defaults",
+			segments: []string{"resize100x"},
+			result:   "resize100x/formatpng",
+		},
+		{
+			name:     "case and empty segments",
+			segments: []string{"", "Resize100X", "", "FormatJPEG"},
+			result:   "resize100x/formatjpeg",
+		},
+		{
+			name:     "options are not ordered",
+			segments: []string{"formatwebp", "backgroundff0000", "crop10x20+5+6"},
+			result:   "crop10x20+5+6/backgroundff0000/formatwebp",
+		},
+		{
+			name:     "transparent background",
+			segments: []string{"backgroundnone", "stretch10x20"},
+			result:   "stretch10x20/formatpng",
+		},
+		{
+			name:     "rotation is normalized",
+			segments: []string{"rotate-90", "rotate450", "rotate360"},
+			result:   "rotate270/rotate90/formatpng",
+		},
+		{
+			name:     "numbers are normalized",
+			segments: []string{"resize0100x0200", "blur1.50", "sharpen02"},
+			result:   "resize100x200/blur1.5/sharpen2/formatpng",
+		},
+		{
+			name:     "operations keep their order",
+			segments: []string{"flip", "grayscale", "overlaylogos-abc-1", "flop"},
+			result:   "flip/grayscale/overlaylogos-abc-1/flop/formatpng",
+		},
+		{
+			name:     "centered crop",
+			segments: []string{"crop300x200", "resizex50"},
+			result:   "crop300x200/resizex50/formatpng",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParsePipeline(test.segments)
+			if err != nil {
+				t.Fatalf("cannot parse %v: %v", test.segments, err)
+			}
+			if p.String() != test.result {
+				t.Errorf("%v: got %s, expected %s", test.segments, p.String(), test.result)
+			}
+			// the canonical form is stable
+			p2, err := ParsePipeline(strings.Split(p.String(), "/"))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", p.String(), err)
+			}
+			if p2.String() != p.String() {
+				t.Errorf("%s: got %s after parsing again", p.String(), p2.String())
+			}
+		})
+	}
+}
+
+func TestParsePipelineInvalid(t *testing.T) {
+	tooMany := make([]string, pipelineMaxOps+1)
+	for i := range tooMany {
+		tooMany[i] = "flip"
+	}
+	tests := [][]string{
+		{},
+		{"", "formatpng"},
+		{"rotate0"},
+		{"unknown"},
+		{"resize"},
+		{"resizeaxb"},
+		{"resize30000x"},
+		{"stretch100x"},
+		{"crop0x10"},
+		{"crop10x10+5"},
+		{"rotatenan"},
+		{"rotateinf"},
+		{"blur0"},
+		{"sharpen101"},
+		{"flipx"},
+		{"overlaylogos"},
+		{"resize10x", "formatbmp"},
+		{"resize10x", "backgroundred"},
+		tooMany,
+	}
+	for _, segments := range tests {
+		p, err := ParsePipeline(segments)
+		if err == nil {
+			t.Errorf("no error for %v: %s", segments, p.String())
+			continue
+		}
+		if !IsParamError(err) {
+			t.Errorf("%v: %v is no parameter error", segments, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/goph/emperror"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mimetypes of camera raw formats, as reported by siegfried
+var rawMimetypes = map[string]bool{
+	"image/x-adobe-dng":     true,
+	"image/dng":             true,
+	"image/x-canon-cr2":     true,
+	"image/x-canon-crw":     true,
+	"image/x-nikon-nef":     true,
+	"image/x-nikon-nrw":     true,
+	"image/x-sony-arw":      true,
+	"image/x-sony-srf":      true,
+	"image/x-sony-sr2":      true,
+	"image/x-fuji-raf":      true,
+	"image/x-olympus-orf":   true,
+	"image/x-panasonic-rw2": true,
+	"image/x-panasonic-raw": true,
+	"image/x-pentax-pef":    true,
+	"image/x-samsung-srw":   true,
+}
+
+// raw formats based on tiff are often identified as tiff
+var rawExtensions = map[string]string{
+	"dng": "image/x-adobe-dng",
+	"cr2": "image/x-canon-cr2",
+	"nef": "image/x-nikon-nef",
+	"nrw": "image/x-nikon-nrw",
+	"arw": "image/x-sony-arw",
+	"sr2": "image/x-sony-sr2",
+	"orf": "image/x-olympus-orf",
+	"rw2": "image/x-panasonic-rw2",
+	"pef": "image/x-pentax-pef",
+	"srw": "image/x-samsung-srw",
+}
+
+func IsRawMimetype(mimetype string) bool {
+	return rawMimetypes[strings.ToLower(mimetype)]
+}
+
+// RawMimetype corrects a generic mimetype of a raw file based on the extension of its urn
+func RawMimetype(mimetype, urn string) string {
+	switch strings.ToLower(mimetype) {
+	case "image/tiff", "application/octet-stream", "":
+	default:
+		return mimetype
+	}
+	pos := strings.LastIndex(urn, ".")
+	if pos < 0 {
+		return mimetype
+	}
+	if raw, ok := rawExtensions[strings.ToLower(urn[pos+1:])]; ok {
+		return raw
+	}
+	return mimetype
+}
+
+// result of dcraw -i -v
+type RawInfo struct {
+	Camera      string `json:"camera,omitempty"`
+	Width       int64  `json:"width"`
+	Height      int64  `json:"height"`
+	ThumbWidth  int64  `json:"thumbwidth,omitempty"`
+	ThumbHeight int64  `json:"thumbheight,omitempty"`
+}
+
+var rawSizeRegexp = regexp.MustCompile(`^(\d+)\s*x\s*(\d+)$`)
+
+func parseRawSize(str string) (width, height int64, err error) {
+	matches := rawSizeRegexp.FindStringSubmatch(strings.TrimSpace(str))
+	if matches == nil {
+		return 0, 0, fmt.Errorf("invalid size %s", str)
+	}
+	width, _ = strconv.ParseInt(matches[1], 10, 64)
+	height, _ = strconv.ParseInt(matches[2], 10, 64)
+	return
+}
+
+func parseRawInfo(out string) (*RawInfo, error) {
+	ri := &RawInfo{}
+	var err error
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "Camera":
+			ri.Camera = strings.TrimSpace(parts[1])
+		case "Thumb size":
+			if ri.ThumbWidth, ri.ThumbHeight, err = parseRawSize(parts[1]); err != nil {
+				return nil, emperror.Wrap(err, "cannot parse thumb size")
+			}
+		case "Output size":
+			// dimensions after demosaicing and rotation
+			if ri.Width, ri.Height, err = parseRawSize(parts[1]); err != nil {
+				return nil, emperror.Wrap(err, "cannot parse output size")
+			}
+		}
+	}
+	if ri.Width == 0 || ri.Height == 0 {
+		return nil, fmt.Errorf("no output size in dcraw result: %s", out)
+	}
+	return ri, nil
+}
+
+// GetRawInfo identifies a local raw file with dcraw
+func GetRawInfo(dcraw, filename string, timeout time.Duration) (*RawInfo, error) {
+	cmdparam := []string{"-i", "-v", filename}
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, dcraw, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v %v", dcraw, cmdparam, out.String(), errb.String())
+	}
+	return parseRawInfo(out.String())
+}
+
+type RawDecoder struct {
+	dcraw      string
+	tempfolder string
+	timeout    time.Duration
+}
+
+func NewRawDecoder(dcraw, tempfolder string, timeout time.Duration) (*RawDecoder, error) {
+	rd := &RawDecoder{
+		dcraw:      dcraw,
+		tempfolder: tempfolder,
+		timeout:    timeout,
+	}
+	return rd, nil
+}
+
+func (rd *RawDecoder) run(cmdparam []string) (*bytes.Buffer, error) {
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), rd.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, rd.dcraw, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v", rd.dcraw, cmdparam, errb.String())
+	}
+	return &out, nil
+}
+
+// the embedded preview is sufficient, if it covers the requested size and has the same orientation
+func (ri *RawInfo) previewFits(width, height int64) bool {
+	if ri.ThumbWidth == 0 || ri.ThumbHeight == 0 || (width == 0 && height == 0) {
+		return false
+	}
+	if (ri.ThumbWidth > ri.ThumbHeight) != (ri.Width > ri.Height) {
+		return false
+	}
+	return width <= ri.ThumbWidth && height <= ri.ThumbHeight
+}
+
+/*
+Decode converts a raw image into a format, which can be loaded by the image backends.
+If the embedded preview is large enough for width and height, it is extracted instead
+of demosaicing the whole sensor data.
+Full decoding uses camera white balance, AHD interpolation and sRGB output as 8 bit tiff.
+*/
+func (rd *RawDecoder) Decode(reader io.Reader, width, height int64) (io.Reader, error) {
+	f, err := ioutil.TempFile(rd.tempfolder, "raw-in-")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create temp file in %s", rd.tempfolder)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return nil, emperror.Wrapf(err, "cannot write temp file %s", f.Name())
+	}
+	f.Close()
+
+	info, err := GetRawInfo(rd.dcraw, f.Name(), rd.timeout)
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot identify raw image")
+	}
+	if info.previewFits(width, height) {
+		out, err := rd.run([]string{"-e", "-c", f.Name()})
+		if err == nil && out.Len() > 0 {
+			return out, nil
+		}
+		// fall back to full decoding
+	}
+	out, err := rd.run([]string{"-c", "-w", "-q", "3", "-o", "1", "-T", f.Name()})
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot decode raw image")
+	}
+	return out, nil
+}
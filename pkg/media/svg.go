@@ -0,0 +1,208 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/goph/emperror"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// elements which are removed including their content
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// only raster images may be embedded, svg data could contain scripts again
+var svgDataURIRegexp = regexp.MustCompile(`^data:image/(png|jpeg|gif|webp);base64,`)
+
+var svgCSSUrlRegexp = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]*)['"]?\s*\)`)
+var svgCSSImportRegexp = regexp.MustCompile(`(?i)@import[^;]*;?`)
+
+// internal entities with literal values, used by some editors for namespaces
+var svgEntityRegexp = regexp.MustCompile(`<!ENTITY\s+([A-Za-z_][\w.-]*)\s+(?:"([^"%&]*)"|'([^'%&]*)')\s*>`)
+
+func svgAllowedReference(element, ref string) bool {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "#") || svgDataURIRegexp.MatchString(ref) {
+		return true
+	}
+	// links are navigation only, they do not load anything
+	if element == "a" {
+		lower := strings.ToLower(ref)
+		return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "mailto:")
+	}
+	return false
+}
+
+// removes external url() references and imports from css
+func svgSanitizeCSS(css string) string {
+	css = svgCSSImportRegexp.ReplaceAllString(css, "")
+	css = svgCSSUrlRegexp.ReplaceAllStringFunc(css, func(str string) string {
+		ref := svgCSSUrlRegexp.FindStringSubmatch(str)[1]
+		if strings.HasPrefix(strings.TrimSpace(ref), "#") {
+			return str
+		}
+		return "none"
+	})
+	if strings.Contains(strings.ToLower(css), "expression(") {
+		return ""
+	}
+	return css
+}
+
+func svgQName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// text keeps its line breaks, attribute values are escaped completely by xml.EscapeText
+var svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// filters attributes of an element. returns false, if the whole element has to be removed
+func svgSanitizeAttrs(element string, attrs []xml.Attr) ([]xml.Attr, bool) {
+	var result []xml.Attr
+	for _, attr := range attrs {
+		name := strings.ToLower(attr.Name.Local)
+		value := strings.ToLower(strings.TrimSpace(attr.Value))
+		switch {
+		case strings.HasPrefix(name, "on"):
+			continue
+		case strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:"):
+			continue
+		case name == "href" || name == "src":
+			if !svgAllowedReference(element, attr.Value) {
+				continue
+			}
+		case name == "style":
+			attr.Value = svgSanitizeCSS(attr.Value)
+		case name == "attributename" && (value == "href" || strings.HasSuffix(value, ":href") || strings.HasPrefix(value, "on")):
+			// animations must not change links or event handlers
+			return nil, false
+		case strings.Contains(value, "url("):
+			attr.Value = svgSanitizeCSS(attr.Value)
+		}
+		result = append(result, attr)
+	}
+	return result, true
+}
+
+/*
+SanitizeSVG copies an svg document from reader to writer without scripts, event handlers,
+comments, processing instructions and references to external resources.
+Only internal references (#id) and embedded raster images are kept, so the result can be
+delivered to browsers and rendered without accessing anything outside of the document.
+*/
+func SanitizeSVG(reader io.Reader, writer io.Writer) error {
+	decoder := xml.NewDecoder(reader)
+	decoder.Entity = map[string]string{}
+	w := bufio.NewWriter(writer)
+
+	if _, err := w.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n"); err != nil {
+		return emperror.Wrap(err, "cannot write svg header")
+	}
+	var root bool
+	// depth of removed element, 0 if not inside a removed element
+	var skip int
+	// name of the current element
+	var stack []string
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return emperror.Wrap(err, "cannot parse svg")
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			local := strings.ToLower(t.Name.Local)
+			if !root {
+				if local != "svg" {
+					return fmt.Errorf("root element %s is not svg", svgQName(t.Name))
+				}
+				root = true
+			}
+			attrs, ok := svgSanitizeAttrs(local, t.Attr)
+			if svgForbiddenElements[local] || !ok {
+				skip = 1
+				continue
+			}
+			stack = append(stack, local)
+			w.WriteString("<" + svgQName(t.Name))
+			for _, attr := range attrs {
+				w.WriteString(" " + svgQName(attr.Name) + `="`)
+				xml.EscapeText(w, []byte(attr.Value))
+				w.WriteString(`"`)
+			}
+			w.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(stack) == 0 {
+				return fmt.Errorf("unexpected end element %s", svgQName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+			w.WriteString("</" + svgQName(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || len(stack) == 0 {
+				continue
+			}
+			text := string(t)
+			if stack[len(stack)-1] == "style" {
+				text = svgSanitizeCSS(text)
+			}
+			svgTextEscaper.WriteString(w, text)
+		case xml.Directive:
+			// doctype is removed, internal entities are resolved by the decoder
+			for _, match := range svgEntityRegexp.FindAllStringSubmatch(string(t), -1) {
+				decoder.Entity[match[1]] = match[2] + match[3]
+			}
+		case xml.Comment, xml.ProcInst:
+		}
+	}
+	if !root {
+		return fmt.Errorf("no svg element found")
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unexpected end of svg in element %s", stack[len(stack)-1])
+	}
+	if err := w.Flush(); err != nil {
+		return emperror.Wrap(err, "cannot write svg")
+	}
+	return nil
+}
+
+// SVGSize returns the intrinsic size of an svg document. it is sanitized first, like for rasterizing
+func SVGSize(reader io.Reader) (width, height int64, err error) {
+	var buf bytes.Buffer
+	if err := SanitizeSVG(reader, &buf); err != nil {
+		return 0, 0, emperror.Wrap(err, "cannot sanitize svg")
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.PingImageBlob(buf.Bytes()); err != nil {
+		return 0, 0, emperror.Wrap(err, "cannot ping svg")
+	}
+	return int64(mw.GetImageWidth()), int64(mw.GetImageHeight()), nil
+}
@@ -0,0 +1,134 @@
+package media
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name    string
+		svg     string
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "script element",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><rect width="1" height="1"/></svg>`,
+			removed: []string{"script", "alert"},
+			kept:    []string{"<rect"},
+		},
+		{
+			name:    "script with cdata",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><script><![CDATA[alert(1)]]></script></svg>`,
+			removed: []string{"script", "alert"},
+		},
+		{
+			name:    "foreign object",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><foreignObject><iframe src="https://example.com"/></foreignObject></svg>`,
+			removed: []string{"foreignObject", "iframe", "example.com"},
+		},
+		{
+			name:    "event handlers",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><rect onclick="alert(2)" OnMouseOver="alert(3)" width="1"/></svg>`,
+			removed: []string{"onload", "onclick", "OnMouseOver", "alert"},
+			kept:    []string{`width="1"`},
+		},
+		{
+			name:    "javascript link",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href=" JavaScript:alert(1)"><text>x</text></a></svg>`,
+			removed: []string{"alert"},
+			kept:    []string{"<text>x</text>"},
+		},
+		{
+			name:    "external image",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="https://example.com/a.png"/><image href="file:///etc/passwd"/></svg>`,
+			removed: []string{"example.com", "/etc/passwd"},
+			kept:    []string{"<image"},
+		},
+		{
+			name:    "svg data uri",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><image href="data:image/svg+xml;base64,PHN2Zz48L3N2Zz4="/></svg>`,
+			removed: []string{"data:image/svg+xml"},
+		},
+		{
+			name: "internal references",
+			svg:  `<svg xmlns="http://www.w3.org/2000/svg"><image href="data:image/png;base64,iVBORw0KGgo="/><use href="#a"/><rect fill="url(#grad)"/></svg>`,
+			kept: []string{"data:image/png;base64,iVBORw0KGgo=", `href="#a"`, "url(#grad)"},
+		},
+		{
+			name:    "external use",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><use href="https://example.com/sprite.svg#icon"/></svg>`,
+			removed: []string{"example.com"},
+		},
+		{
+			name:    "css url in style attribute",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><rect style="fill: url('https://example.com/p.svg#x'); stroke: red"/></svg>`,
+			removed: []string{"example.com"},
+			kept:    []string{"stroke: red"},
+		},
+		{
+			name:    "css url and import in style element",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><style>@import url(https://example.com/a.css); rect { background: url("https://example.com/b.png") }</style></svg>`,
+			removed: []string{"@import", "example.com"},
+			kept:    []string{"<style>"},
+		},
+		{
+			name:    "css url in presentation attribute",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><rect filter="url(https://example.com/f.svg#f)"/></svg>`,
+			removed: []string{"example.com"},
+		},
+		{
+			name:    "animation of href",
+			svg:     `<svg xmlns="http://www.w3.org/2000/svg"><a><set attributeName="href" to="javascript:alert(1)"/></a></svg>`,
+			removed: []string{"<set", "alert"},
+		},
+		{
+			name:    "internal entity",
+			svg:     `<!DOCTYPE svg [<!ENTITY ns "http://www.w3.org/2000/svg">]><svg xmlns="&ns;"><text>x</text></svg>`,
+			removed: []string{"DOCTYPE", "ENTITY"},
+			kept:    []string{`xmlns="http://www.w3.org/2000/svg"`},
+		},
+		{
+			name:    "comments and processing instructions",
+			svg:     `<?xml-stylesheet href="https://example.com/a.css"?><svg xmlns="http://www.w3.org/2000/svg"><!-- <script>alert(1)</script> --></svg>`,
+			removed: []string{"xml-stylesheet", "example.com", "alert"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := SanitizeSVG(strings.NewReader(test.svg), &buf); err != nil {
+				t.Fatalf("cannot sanitize: %v", err)
+			}
+			result := buf.String()
+			for _, str := range test.removed {
+				if strings.Contains(result, str) {
+					t.Errorf("%q not removed: %s", str, result)
+				}
+			}
+			for _, str := range test.kept {
+				if !strings.Contains(result, str) {
+					t.Errorf("%q not kept: %s", str, result)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeSVGInvalid(t *testing.T) {
+	// external entities, other root elements and incomplete documents are rejected
+	tests := []string{
+		`<!DOCTYPE svg [<!ENTITY ext SYSTEM "file:///etc/passwd">]><svg xmlns="http://www.w3.org/2000/svg"><text>&ext;</text></svg>`,
+		`<html><script>alert(1)</script></html>`,
+		`<svg xmlns="http://www.w3.org/2000/svg"><rect>`,
+		`no xml`,
+	}
+	for _, svg := range tests {
+		var buf bytes.Buffer
+		if err := SanitizeSVG(strings.NewReader(svg), &buf); err == nil {
+			t.Errorf("no error for %q: %s", svg, buf.String())
+		}
+	}
+}
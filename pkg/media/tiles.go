@@ -0,0 +1,206 @@
+package media
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/goph/emperror"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"math"
+)
+
+type TileLevel struct {
+	Width, Height int64
+	Cols, Rows    int64
+}
+
+// TilePyramid describes the levels of a tiled image. level 0 is the smallest one
+type TilePyramid struct {
+	Width, Height int64
+	TileSize      int64
+	Overlap       int64
+	Format        string
+	Levels        []TileLevel
+}
+
+func newTileLevel(width, height, tilesize int64) TileLevel {
+	return TileLevel{
+		Width:  width,
+		Height: height,
+		Cols:   (width + tilesize - 1) / tilesize,
+		Rows:   (height + tilesize - 1) / tilesize,
+	}
+}
+
+/*
+NewDZIPyramid creates the levels of a deep zoom image. every level halves the size of the next one
+(rounded up) down to one pixel
+*/
+func NewDZIPyramid(width, height, tilesize, overlap int64, format string) (*TilePyramid, error) {
+	if width <= 0 || height <= 0 || tilesize <= 0 || overlap < 0 {
+		return nil, fmt.Errorf("invalid pyramid %vx%v with tile size %v", width, height, tilesize)
+	}
+	tp := &TilePyramid{Width: width, Height: height, TileSize: tilesize, Overlap: overlap, Format: format}
+	maxLevel := int(math.Ceil(math.Log2(math.Max(float64(width), float64(height)))))
+	for level := 0; level <= maxLevel; level++ {
+		scale := math.Pow(2, float64(maxLevel-level))
+		tp.Levels = append(tp.Levels, newTileLevel(
+			int64(math.Ceil(float64(width)/scale)),
+			int64(math.Ceil(float64(height)/scale)),
+			tilesize))
+	}
+	return tp, nil
+}
+
+/*
+NewZoomifyPyramid creates the tiers of a zoomify image. every tier halves the size of the next one
+(rounded down) until the image fits into one tile
+*/
+func NewZoomifyPyramid(width, height, tilesize int64, format string) (*TilePyramid, error) {
+	if width <= 0 || height <= 0 || tilesize <= 0 {
+		return nil, fmt.Errorf("invalid pyramid %vx%v with tile size %v", width, height, tilesize)
+	}
+	tp := &TilePyramid{Width: width, Height: height, TileSize: tilesize, Format: format}
+	levels := []TileLevel{newTileLevel(width, height, tilesize)}
+	for w, h := width, height; (w > tilesize || h > tilesize) && w > 1 && h > 1; {
+		w, h = w/2, h/2
+		levels = append([]TileLevel{newTileLevel(w, h, tilesize)}, levels...)
+	}
+	tp.Levels = levels
+	return tp, nil
+}
+
+// Tile returns the region of a tile within its level, including overlap
+func (tp *TilePyramid) Tile(level int, col, row int64) (x, y, width, height int64, err error) {
+	if level < 0 || level >= len(tp.Levels) {
+		return 0, 0, 0, 0, fmt.Errorf("invalid level %v", level)
+	}
+	l := tp.Levels[level]
+	if col < 0 || col >= l.Cols || row < 0 || row >= l.Rows {
+		return 0, 0, 0, 0, fmt.Errorf("invalid tile %v/%v_%v", level, col, row)
+	}
+	x, y = col*tp.TileSize, row*tp.TileSize
+	x2, y2 := x+tp.TileSize+tp.Overlap, y+tp.TileSize+tp.Overlap
+	if col > 0 {
+		x -= tp.Overlap
+	}
+	if row > 0 {
+		y -= tp.Overlap
+	}
+	if x2 > l.Width {
+		x2 = l.Width
+	}
+	if y2 > l.Height {
+		y2 = l.Height
+	}
+	return x, y, x2 - x, y2 - y, nil
+}
+
+// TileGroup is the zoomify folder of a tile. tiles are numbered from the smallest tier, 256 per folder
+func (tp *TilePyramid) TileGroup(level int, col, row int64) int64 {
+	var index int64
+	for i := 0; i < level && i < len(tp.Levels); i++ {
+		index += tp.Levels[i].Cols * tp.Levels[i].Rows
+	}
+	if level < len(tp.Levels) {
+		index += row*tp.Levels[level].Cols + col
+	}
+	return index / 256
+}
+
+// DZI is the xml descriptor of a deep zoom image
+func (tp *TilePyramid) DZI() ([]byte, error) {
+	type size struct {
+		Width  int64 `xml:"Width,attr"`
+		Height int64 `xml:"Height,attr"`
+	}
+	descriptor := struct {
+		XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+		TileSize int64    `xml:"TileSize,attr"`
+		Overlap  int64    `xml:"Overlap,attr"`
+		Format   string   `xml:"Format,attr"`
+		Size     size     `xml:"Size"`
+	}{
+		TileSize: tp.TileSize,
+		Overlap:  tp.Overlap,
+		Format:   tp.Format,
+		Size:     size{Width: tp.Width, Height: tp.Height},
+	}
+	data, err := xml.Marshal(descriptor)
+	if err != nil {
+		return nil, emperror.Wrap(err, "cannot marshal dzi descriptor")
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ZoomifyProperties is the content of ImageProperties.xml
+func (tp *TilePyramid) ZoomifyProperties() []byte {
+	var tiles int64
+	for _, l := range tp.Levels {
+		tiles += l.Cols * l.Rows
+	}
+	return []byte(fmt.Sprintf(`<IMAGE_PROPERTIES WIDTH="%d" HEIGHT="%d" NUMTILES="%d" NUMIMAGES="1" VERSION="1.8" TILESIZE="%d" />`,
+		tp.Width, tp.Height, tiles, tp.TileSize))
+}
+
+// TileWriter receives the encoded tiles of a level
+type TileWriter func(col, row int64, reader io.Reader, size int64) error
+
+/*
+Tiles scales the image to the size of a level and cuts it into tiles.
+jpeg tiles are flattened on white, because they have no alpha channel
+*/
+func (im *ImageMagickV3) Tiles(tp *TilePyramid, level int, write TileWriter) error {
+	if level < 0 || level >= len(tp.Levels) {
+		return fmt.Errorf("invalid level %v", level)
+	}
+	l := tp.Levels[level]
+	im.mw.SetFirstIterator()
+	if err := im.mw.AutoOrientImage(); err != nil {
+		return emperror.Wrap(err, "cannot auto orient image")
+	}
+	mw := im.mw.Clone()
+	defer mw.Destroy()
+	if tp.Format == "jpeg" || tp.Format == "jpg" {
+		pw := imagick.NewPixelWand()
+		defer pw.Destroy()
+		pw.SetColor("white")
+		if err := mw.SetImageBackgroundColor(pw); err != nil {
+			return emperror.Wrap(err, "cannot set background color")
+		}
+		if err := mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE); err != nil {
+			return emperror.Wrap(err, "cannot remove alpha channel")
+		}
+	}
+	if int64(mw.GetImageWidth()) != l.Width || int64(mw.GetImageHeight()) != l.Height {
+		if err := mw.ResizeImage(uint(l.Width), uint(l.Height), imagick.FILTER_LANCZOS); err != nil {
+			return emperror.Wrapf(err, "cannot resizeimage(%v, %v)", l.Width, l.Height)
+		}
+	}
+	for row := int64(0); row < l.Rows; row++ {
+		for col := int64(0); col < l.Cols; col++ {
+			x, y, w, h, err := tp.Tile(level, col, row)
+			if err != nil {
+				return err
+			}
+			tile := mw.Clone()
+			if err := tile.CropImage(uint(w), uint(h), int(x), int(y)); err != nil {
+				tile.Destroy()
+				return emperror.Wrapf(err, "cannot cropimage(%v, %v, %v, %v)", w, h, x, y)
+			}
+			tile.SetImagePage(uint(w), uint(h), 0, 0)
+			if err := tile.SetImageFormat(tp.Format); err != nil {
+				tile.Destroy()
+				return emperror.Wrapf(err, "cannot set format %s", tp.Format)
+			}
+			tile.SetImageCompressionQuality(85)
+			blob := tile.GetImageBlob()
+			tile.Destroy()
+			if err := write(col, row, bytes.NewReader(blob), int64(len(blob))); err != nil {
+				return emperror.Wrapf(err, "cannot write tile %v/%v_%v", level, col, row)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package media
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type VideoAction struct {
+	ff *FFMpeg
+}
+
+type VideoOptions struct {
+	Width, Height int64
+	TargetFormat  string
+	Clip          *ClipOptions
+	Normalize     *LoudnessTarget
+}
+
+func NewVideoAction(ff *FFMpeg) (*VideoAction, error) {
+	va := &VideoAction{ff: ff}
+	return va, nil
+}
+
+func (va *VideoAction) GetType() string {
+	return "video"
+}
+
+func (va *VideoAction) Close() {}
+
+func (va *VideoAction) buildOptions(params map[string]string) (*VideoOptions, error) {
+	var err error
+	var vo = &VideoOptions{
+		TargetFormat: "mp4",
+	}
+	if vo.Clip, err = buildClipOptions(params); err != nil {
+		return nil, emperror.Wrapf(err, "invalid clip parameters %v", params)
+	}
+	if vo.Normalize, err = va.ff.buildNormalize(params); err != nil {
+		return nil, emperror.Wrapf(err, "invalid normalize parameter %v", params)
+	}
+	for key, val := range params {
+		switch key {
+		case "size":
+			sizes := strings.Split(val, "x")
+			if len(sizes) != 2 {
+				return nil, NewParamError("invalid size %s", val)
+			}
+			if sizes[0] != "" {
+				if vo.Width, err = strconv.ParseInt(sizes[0], 10, 64); err != nil {
+					return nil, emperror.Wrapf(err, "cannot parse width integer %s", val)
+				}
+			}
+			if sizes[1] != "" {
+				if vo.Height, err = strconv.ParseInt(sizes[1], 10, 64); err != nil {
+					return nil, emperror.Wrapf(err, "cannot parse height integer %s", val)
+				}
+			}
+		case "format":
+			vo.TargetFormat = val
+		}
+	}
+	return vo, nil
+}
+
+// ffmpeg scale filter which keeps the aspect ratio and even dimensions (needed by h264)
+func (vo *VideoOptions) scaleFilter() string {
+	switch {
+	case vo.Width > 0 && vo.Height > 0:
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,scale=trunc(iw/2)*2:trunc(ih/2)*2", vo.Width, vo.Height)
+	case vo.Width > 0:
+		return fmt.Sprintf("scale=%d:-2", vo.Width)
+	case vo.Height > 0:
+		return fmt.Sprintf("scale=-2:%d", vo.Height)
+	default:
+		return ""
+	}
+}
+
+func (va *VideoAction) Do(master *database.Master, action string, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	if master.Type != "video" {
+		return nil, ErrInvalidType
+	}
+	switch action {
+	case "convert":
+	case "waveform":
+		return va.waveform(master, params, bucket, path, reader)
+	default:
+		return nil, NewParamError("invalid action %s", action)
+	}
+
+	options, err := va.buildOptions(params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot build options from param %v", params)
+	}
+
+	var outparams []string
+	if filter := options.scaleFilter(); filter != "" {
+		outparams = append(outparams, "-vf", filter)
+	}
+	var mimetype string
+	switch options.TargetFormat {
+	case "mp4":
+		mimetype = "video/mp4"
+		outparams = append(outparams, "-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "+faststart")
+	case "webm":
+		mimetype = "video/webm"
+		outparams = append(outparams, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "32", "-c:a", "libopus")
+	default:
+		return nil, NewParamError("invalid format %s", options.TargetFormat)
+	}
+
+	filename, cm, err := va.ff.Convert(reader, options.Clip, options.Normalize, outparams, options.TargetFormat, mimetype)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot convert video %v/%s", master.CollectionId, master.Signature)
+	}
+	defer os.Remove(filename)
+
+	if err := writeFileToStorage(master, bucket, path, filename); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store video %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
+
+func (va *VideoAction) waveform(master *database.Master, params map[string]string, bucket, path string, reader io.Reader) (*CoreMeta, error) {
+	options, err := buildWaveformOptions(params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot build waveform options from param %v", params)
+	}
+	filename, cm, err := va.ff.Waveform(reader, options)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create waveform of %v/%s", master.CollectionId, master.Signature)
+	}
+	defer os.Remove(filename)
+
+	if err := writeFileToStorage(master, bucket, path, filename); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store waveform %v/%s", master.CollectionId, master.Signature)
+	}
+	return cm, nil
+}
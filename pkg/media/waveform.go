@@ -0,0 +1,308 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// samples are decoded as mono s16le with this rate
+const waveformSampleRate = 22050
+
+// min/max are collected in blocks of this size before they are aggregated to pixels
+const waveformBlockSize = 64
+
+type WaveformOptions struct {
+	Width, Height int64
+	TargetFormat  string
+	Color         color.NRGBA
+	Background    color.NRGBA
+	Clip          *ClipOptions
+}
+
+// Peaks is compatible with the json format of audiowaveform, which is used by wavesurfer and peaks.js
+type Peaks struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// parses rrggbb, rrggbbaa or none
+func parseColor(str string) (color.NRGBA, error) {
+	if str == "none" {
+		return color.NRGBA{}, nil
+	}
+	b, err := hex.DecodeString(str)
+	if err != nil {
+		return color.NRGBA{}, emperror.Wrapf(err, "invalid color %s", str)
+	}
+	switch len(b) {
+	case 3:
+		return color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}, nil
+	case 4:
+		return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+	default:
+		return color.NRGBA{}, NewParamError("invalid color %s", str)
+	}
+}
+
+func buildWaveformOptions(params map[string]string) (*WaveformOptions, error) {
+	var err error
+	var wo = &WaveformOptions{
+		Width:        1000,
+		Height:       200,
+		TargetFormat: "png",
+		Color:        color.NRGBA{R: 0x33, G: 0x66, B: 0xcc, A: 0xff},
+	}
+	if wo.Clip, err = buildClipOptions(params); err != nil {
+		return nil, emperror.Wrapf(err, "invalid clip parameters %v", params)
+	}
+	for key, val := range params {
+		switch key {
+		case "size":
+			sizes := strings.Split(val, "x")
+			if len(sizes) != 2 {
+				return nil, NewParamError("invalid size %s", val)
+			}
+			if sizes[0] != "" {
+				if wo.Width, err = strconv.ParseInt(sizes[0], 10, 64); err != nil {
+					return nil, emperror.Wrapf(err, "cannot parse width integer %s", val)
+				}
+			}
+			if sizes[1] != "" {
+				if wo.Height, err = strconv.ParseInt(sizes[1], 10, 64); err != nil {
+					return nil, emperror.Wrapf(err, "cannot parse height integer %s", val)
+				}
+			}
+		case "color":
+			if wo.Color, err = parseColor(val); err != nil {
+				return nil, err
+			}
+		case "background":
+			if wo.Background, err = parseColor(val); err != nil {
+				return nil, err
+			}
+		case "format":
+			wo.TargetFormat = val
+		}
+	}
+	if wo.Width <= 0 || wo.Height <= 0 || wo.Width > 10000 || wo.Height > 2000 {
+		return nil, NewParamError("invalid waveform size %vx%v", wo.Width, wo.Height)
+	}
+	return wo, nil
+}
+
+// decodes the audio track and collects min/max values per block
+func (ff *FFMpeg) decodePeaks(infile string, clip *ClipOptions) (mins, maxs []int16, err error) {
+	cmdparam := []string{"-hide_banner", "-nostdin"}
+	var inclip, outclip []string
+	if clip != nil {
+		inclip, outclip = clip.params()
+	}
+	cmdparam = append(cmdparam, inclip...)
+	cmdparam = append(cmdparam, "-i", infile)
+	cmdparam = append(cmdparam, outclip...)
+	cmdparam = append(cmdparam, "-vn", "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "-")
+
+	var errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), ff.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ff.ffmpeg, cmdparam...)
+	cmd.Stderr = &errb
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, emperror.Wrap(err, "cannot get stdout of ffmpeg")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, emperror.Wrapf(err, "cannot start (%s %s)", ff.ffmpeg, cmdparam)
+	}
+
+	var buf = make([]byte, 64*1024)
+	var min, max int16
+	var count int
+	for {
+		var n int
+		n, err = io.ReadFull(stdout, buf)
+		for i := 0; i+1 < n; i += 2 {
+			sample := int16(binary.LittleEndian.Uint16(buf[i:]))
+			if count == 0 || sample < min {
+				min = sample
+			}
+			if count == 0 || sample > max {
+				max = sample
+			}
+			count++
+			if count == waveformBlockSize {
+				mins = append(mins, min)
+				maxs = append(maxs, max)
+				count = 0
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if count > 0 {
+		mins = append(mins, min)
+		maxs = append(maxs, max)
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		cmd.Wait()
+		return nil, nil, emperror.Wrap(err, "cannot read samples")
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, nil, emperror.Wrapf(err, "error executing (%s %s): %v", ff.ffmpeg, cmdparam, errb.String())
+	}
+	if len(mins) == 0 {
+		return nil, nil, fmt.Errorf("no audio samples in %s", infile)
+	}
+	return mins, maxs, nil
+}
+
+// aggregates blocks to width pixels with 8 bit resolution
+func buildPeaks(mins, maxs []int16, width int64) *Peaks {
+	blocksPerPixel := (int64(len(mins)) + width - 1) / width
+	peaks := &Peaks{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      waveformSampleRate,
+		SamplesPerPixel: int(blocksPerPixel * waveformBlockSize),
+		Bits:            8,
+	}
+	for start := int64(0); start < int64(len(mins)); start += blocksPerPixel {
+		end := start + blocksPerPixel
+		if end > int64(len(mins)) {
+			end = int64(len(mins))
+		}
+		min, max := mins[start], maxs[start]
+		for i := start + 1; i < end; i++ {
+			if mins[i] < min {
+				min = mins[i]
+			}
+			if maxs[i] > max {
+				max = maxs[i]
+			}
+		}
+		peaks.Data = append(peaks.Data, int8(min>>8), int8(max>>8))
+		peaks.Length++
+	}
+	return peaks
+}
+
+// pixel rows of a peak pair
+func (wo *WaveformOptions) rows(min, max int8) (top, bottom int) {
+	center := float64(wo.Height) / 2
+	top = int(center - float64(max)*center/128)
+	bottom = int(center - float64(min)*center/128)
+	if bottom <= top {
+		bottom = top + 1
+	}
+	return
+}
+
+func (wo *WaveformOptions) renderPNG(peaks *Peaks, w io.Writer) error {
+	img := image.NewNRGBA(image.Rect(0, 0, int(wo.Width), int(wo.Height)))
+	for y := 0; y < int(wo.Height); y++ {
+		for x := 0; x < int(wo.Width); x++ {
+			img.SetNRGBA(x, y, wo.Background)
+		}
+	}
+	for x := 0; x < peaks.Length && x < int(wo.Width); x++ {
+		top, bottom := wo.rows(peaks.Data[2*x], peaks.Data[2*x+1])
+		for y := top; y < bottom; y++ {
+			img.SetNRGBA(x, y, wo.Color)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+func svgColor(c color.NRGBA) string {
+	if c.A == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (wo *WaveformOptions) renderSVG(peaks *Peaks, w io.Writer) error {
+	var path strings.Builder
+	for x := 0; x < peaks.Length && x < int(wo.Width); x++ {
+		top, bottom := wo.rows(peaks.Data[2*x], peaks.Data[2*x+1])
+		fmt.Fprintf(&path, "M%d.5 %dV%d", x, top, bottom)
+	}
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+		`<rect width="100%%" height="100%%" fill="%s" fill-opacity="%.3f"/>`+
+		`<path d="%s" stroke="%s" stroke-opacity="%.3f" stroke-width="1" fill="none"/></svg>`,
+		wo.Width, wo.Height, wo.Width, wo.Height,
+		svgColor(wo.Background), float64(wo.Background.A)/255,
+		path.String(), svgColor(wo.Color), float64(wo.Color.A)/255)
+	return err
+}
+
+// Waveform renders the waveform of the audio track as png, svg or peaks json into a temp file.
+// the caller has to remove the resulting file
+func (ff *FFMpeg) Waveform(reader io.Reader, options *WaveformOptions) (string, *CoreMeta, error) {
+	infile, err := ff.tempInput(reader)
+	if err != nil {
+		return "", nil, emperror.Wrap(err, "cannot create ffmpeg input")
+	}
+	defer os.Remove(infile)
+
+	mins, maxs, err := ff.decodePeaks(infile, options.Clip)
+	if err != nil {
+		return "", nil, emperror.Wrap(err, "cannot decode audio")
+	}
+	peaks := buildPeaks(mins, maxs, options.Width)
+
+	out, err := ioutil.TempFile(ff.tempfolder, "waveform-")
+	if err != nil {
+		return "", nil, emperror.Wrapf(err, "cannot create temp file in %s", ff.tempfolder)
+	}
+	defer out.Close()
+
+	cm := &CoreMeta{
+		Format: options.TargetFormat,
+	}
+	switch options.TargetFormat {
+	case "png":
+		cm.Mimetype = "image/png"
+		cm.Width, cm.Height = options.Width, options.Height
+		err = options.renderPNG(peaks, out)
+	case "svg":
+		cm.Mimetype = "image/svg+xml"
+		cm.Width, cm.Height = options.Width, options.Height
+		err = options.renderSVG(peaks, out)
+	case "json":
+		cm.Mimetype = "application/json"
+		err = json.NewEncoder(out).Encode(peaks)
+	default:
+		err = NewParamError("invalid format %s", options.TargetFormat)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", nil, emperror.Wrapf(err, "cannot write waveform to %s", out.Name())
+	}
+	finfo, err := out.Stat()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", nil, emperror.Wrapf(err, "cannot stat %s", out.Name())
+	}
+	cm.Size = finfo.Size()
+	return out.Name(), cm, nil
+}
@@ -2,7 +2,9 @@ package mediaserver
 
 import (
 	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/goph/emperror"
 	"github.com/gorilla/mux"
@@ -12,12 +14,15 @@ import (
 	"github.com/op/go-logging"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type MediaHandler struct {
@@ -29,14 +34,38 @@ type MediaHandler struct {
 	idx        *Indexer
 	pbx        ParamBuilder
 	tempfolder string
+	srcset     map[string]*SrcsetPreset
+	tiles      TileOptions
+	tileLocks  [tileLockStripes]sync.Mutex
+	geo        *media.GeoWarper
+	ocr        *media.OCR
+	ocrIngest  bool
+	access     *AccessRecorder
+	coalesce   coalescer
+	locking    bool
+	lockWait   time.Duration
+	jobs       *JobQueue
+	presets    map[string]string
+	warmup     map[string][]string
+	warmers    int
+	warmQueue  chan *warmupTask
+	warmOnce   sync.Once
+	adminToken string
+	backoff    time.Duration
+	maxBackoff time.Duration
+	errorImage string
 }
 
 func _buildFilename(coll *database.Collection, master *database.Master, action string, params []string) string {
 	return fmt.Sprintf("%v.%v-%x", coll.Id, master.Id, md5.Sum([]byte(fmt.Sprintf("%s/%s/%s/%s", coll.Name, master.Signature, action, strings.Join(params, "/")))))
 }
 
+func buildHash(collection, signature, action, paramstr string) [md5.Size]byte {
+	return md5.Sum([]byte(fmt.Sprintf("%s/%s/%s/%s", collection, signature, action, paramstr)))
+}
+
 func buildFilename(coll *database.Collection, master *database.Master, action string, paramstr string) string {
-	return fmt.Sprintf("%v.%v-%x", coll.Id, master.Id, md5.Sum([]byte(fmt.Sprintf("%s/%s/%s/%s", coll.Name, master.Signature, action, paramstr))))
+	return fmt.Sprintf("%v.%v-%x", coll.Id, master.Id, buildHash(coll.Name, master.Signature, action, paramstr))
 }
 
 func NewMediaHandler(
@@ -49,13 +78,20 @@ func NewMediaHandler(
 	fss []filesystem.FileSystem,
 	actions []media.Action) (*MediaHandler, error) {
 	mh := &MediaHandler{
-		log:    log,
-		prefix: prefix,
-		mdb:    mdb,
-		fss:    make(map[string]filesystem.FileSystem),
-		pbx:    pbx,
-		idx:    idx,
-		action: make(map[string]media.Action),
+		log:     log,
+		prefix:  prefix,
+		mdb:     mdb,
+		fss:     make(map[string]filesystem.FileSystem),
+		pbx:     pbx,
+		idx:     idx,
+		action:  make(map[string]media.Action),
+		srcset:  make(map[string]*SrcsetPreset),
+		presets: make(map[string]string),
+		tiles: TileOptions{
+			TileSize: DefaultTileSize,
+			Overlap:  DefaultTileOverlap,
+			Format:   DefaultTileFormat,
+		},
 	}
 	mh.idx.SetMediaHandler(mh)
 	for _, fs := range fss {
@@ -81,6 +117,58 @@ func NewMediaHandler(
 	return mh, nil
 }
 
+// overlays are read into memory completely
+const overlayMaxSize = 64 << 20
+
+// the master was invalidated during the creation of a derivative
+var errMasterChanged = errors.New("master changed during creation")
+
+/*
+OpenOverlay opens the image of collection/signature for the overlay of a pipeline. only image masters
+are allowed, svg and raw masters are read from their sanitized png derivative
+*/
+func (mh *MediaHandler) OpenOverlay(collection, signature string) (io.ReadCloser, error) {
+	// an unusable overlay is an error of the request, not of the master
+	cache, err := mh.GetCache(collection, signature, "master", "")
+	if err != nil {
+		return nil, media.NewParamError("cannot get overlay %s/%s: %v", collection, signature, err)
+	}
+	master, err := cache.GetMaster()
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	if master.Type != "image" {
+		return nil, media.NewParamError("master %s/%s of type %s cannot be used as overlay", collection, signature, master.Type)
+	}
+	if master.Mimetype == "image/svg+xml" || media.IsRawMimetype(master.Mimetype) {
+		if cache, err = mh.GetCache(collection, signature, "resize", "formatpng"); err != nil {
+			return nil, media.NewParamError("cannot convert overlay %s/%s: %v", collection, signature, err)
+		}
+	}
+	if cache.Filesize > overlayMaxSize {
+		return nil, media.NewParamError("overlay %s/%s is larger than %v bytes", collection, signature, overlayMaxSize)
+	}
+	reader, _, err := mh.FileOpenRead(cache.Path, filesystem.FileGetOptions{})
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot open %s", cache.Path)
+	}
+	return reader, nil
+}
+
+// deliveries of cache entries are recorded for lastaccess
+func (mh *MediaHandler) SetAccessRecorder(access *AccessRecorder) {
+	mh.access = access
+}
+
+func (mh *MediaHandler) AddAction(action media.Action) {
+	mh.action[action.GetType()] = action
+}
+
+// local folder for temporary files
+func (mh *MediaHandler) GetTempFolder() string {
+	return mh.tempfolder
+}
+
 var pathRegexp = regexp.MustCompile(`^([^:]+://[^/]+)/([^/]+)(/.+)?$`)
 
 func (mh *MediaHandler) GetFS(path string) (filesystem.FileSystem, string, string, error) {
@@ -113,6 +201,65 @@ func (mh *MediaHandler) FileWrite(path string, reader io.Reader, size int64, opt
 	}
 	return fs.FileWrite(bucket, path, reader, size, opts)
 }
+func (mh *MediaHandler) FileDeleteAll(path string) error {
+	fs, bucket, path, err := mh.GetFS(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileDeleteAll(bucket, path)
+}
+
+// removeCache deletes the file first, so that no entry without file remains
+func (mh *MediaHandler) removeCache(cache *database.Cache) error {
+	// invalid paths cannot be served anyway
+	if fs, bucket, path, err := mh.GetFS(cache.Path); err != nil {
+		mh.log.Warningf("cache #%v has no valid path: %v", cache.Id, err)
+	} else if err := fs.FileDelete(bucket, path); err != nil && !filesystem.IsNotFoundError(err) {
+		return emperror.Wrapf(err, "cannot delete %s", cache.Path)
+	}
+	if err := cache.Delete(); err != nil {
+		return emperror.Wrapf(err, "cannot delete cache #%v", cache.Id)
+	}
+	return nil
+}
+
+/*
+localCopy returns a local filename with the content of path for tools, which need a seekable file.
+files on remote filesystems are copied to the temp folder, cleanup removes the copy
+*/
+func (mh *MediaHandler) localCopy(path string) (string, func(), error) {
+	fs, bucket, fpath, err := mh.GetFS(path)
+	if err != nil {
+		return "", nil, emperror.Wrapf(err, "cannot get filesystem for %s", path)
+	}
+	if fs.IsLocal() {
+		u, err := fs.GETUrl(bucket, fpath, 0)
+		if err != nil {
+			return "", nil, emperror.Wrapf(err, "cannot get url for %s", path)
+		}
+		return u.Path, func() {}, nil
+	}
+	reader, _, err := fs.FileOpenRead(bucket, fpath, filesystem.FileGetOptions{})
+	if err != nil {
+		return "", nil, emperror.Wrapf(err, "cannot open %s", path)
+	}
+	defer reader.Close()
+	f, err := ioutil.TempFile(mh.GetTempFolder(), "local-")
+	if err != nil {
+		return "", nil, emperror.Wrapf(err, "cannot create temp file in %s", mh.GetTempFolder())
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, emperror.Wrapf(err, "cannot write temp file %s", f.Name())
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return "", nil, emperror.Wrapf(err, "cannot close temp file %s", f.Name())
+	}
+	return f.Name(), cleanup, nil
+}
 
 var errorTemplate = template.Must(template.New("error").Parse(`<html>
 <head><title>{{.Error}}</title></head>
@@ -156,11 +303,20 @@ func (mh *MediaHandler) ServeContent(w http.ResponseWriter, r *http.Request, pat
 	http.ServeContent(w, r, finfo.Name(), finfo.ModTime(), reader)
 }
 
-func (mh *MediaHandler) GetCache(collection, signature, action, paramstr string) (*database.Cache, error) {
+// normalize returns the allowed parameters of action and the canonical parameter string
+func (mh *MediaHandler) normalize(action, paramstr string) (map[string]string, string, error) {
+	if action == "pipeline" {
+		// order of operations is significant
+		pipeline, err := mh.pbx.Pipeline(action, strings.Split(paramstr, "/"))
+		if err != nil {
+			return nil, "", emperror.Wrapf(err, "invalid pipeline %s", paramstr)
+		}
+		return map[string]string{"pipeline": pipeline}, pipeline, nil
+	}
 	// clear parameters
 	params, err := mh.pbx.Clear(action, strings.Split(paramstr, "/"))
 	if err != nil {
-		return nil, emperror.Wrapf(err, "cannot clear params %s for action %s", paramstr, action)
+		return nil, "", emperror.Wrapf(err, "cannot clear params %s for action %s", paramstr, action)
 	}
 	// rebuild paramstring (sorted)
 	ps := []string{}
@@ -168,69 +324,63 @@ func (mh *MediaHandler) GetCache(collection, signature, action, paramstr string)
 		ps = append(ps, key+val)
 	}
 	sort.Strings(ps)
+	return params, strings.Join(ps, "/"), nil
+}
 
-	paramstr = strings.Join(ps, "/")
+func (mh *MediaHandler) GetCache(collection, signature, action, paramstr string) (*database.Cache, error) {
+	if action == "preset" {
+		presetAction, presetParams, err := mh.resolvePreset(collection, paramstr)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot resolve preset %s", paramstr)
+		}
+		action, paramstr = presetAction, presetParams
+	}
+	if action == "caption" {
+		fieldParams, err := mh.resolveCaptionField(collection, signature, paramstr)
+		if err != nil {
+			return nil, err
+		}
+		paramstr = fieldParams
+	}
+	params, paramstr, err := mh.normalize(action, paramstr)
+	if err != nil {
+		return nil, err
+	}
 	cache, err := mh.mdb.GetCache(collection, signature, action, paramstr)
 	if err == database.ErrNotFound {
-		if action == "master" {
-			master, cache, err := mh.ingestMaster(collection, signature)
-			if err != nil {
-				return nil, emperror.Wrapf(err, "cannot ingest master %s/%s", collection, signature)
-			}
-			mh.log.Infof("master: %v // %v", master, cache)
-			cache, err = mh.mdb.GetCache(collection, signature, action, paramstr)
-		} else {
-			coll, err := mh.mdb.GetCollectionByName(collection)
-			if err != nil {
-				return nil, emperror.Wrapf(err, "invalid collection %s", collection)
-			}
-			stor, err := coll.GetStorage()
-			if err != nil {
-				return nil, emperror.Wrapf(err, "cannot get storage #%v from collection %s", coll.StorageId, collection)
-			}
-			master, err := mh.mdb.GetMaster(coll, signature)
-			if err != nil {
-				return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
-			}
-			act, ok := mh.action[master.Type]
-			if !ok {
-				return nil, fmt.Errorf("invalid type %s for %s/%s", master.Type, collection, signature)
-			}
-			mastercache, err := mh.mdb.GetCacheByMaster(master, "master", "")
-			if err != nil {
-				// ingest???
-				return nil, emperror.Wrapf(err, "cannot load master cache of %s/%s", collection, signature)
-			}
-			file, _, err := mh.FileOpenRead(mastercache.Path, filesystem.FileGetOptions{})
-			if err != nil {
-				return nil, emperror.Wrapf(err, "open master cache file %s of %s/%s", mastercache.Path, collection, signature)
-			}
-			filename := buildFilename(coll, master, action, paramstr)
-			bucket, err := stor.GetBucket()
-			if err != nil {
-				return nil, emperror.Wrapf(err, "cannot get bucket from stor %s - %s", stor.Name, stor.Filebase)
-			}
-			cm, err := act.Do(master, action, params, bucket, filename, file)
-			cache, err = database.NewCache(
-				mh.mdb,
-				0,
-				coll.Id,
-				master.Id,
-				action,
-				paramstr,
-				cm.Mimetype,
-				cm.Size,
-				fmt.Sprintf("%s/%s", "data", filename),
-				cm.Width,
-				cm.Height,
-				0)
-			if err != nil {
-				return nil, emperror.Wrapf(err, "cannot create cache %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
-			}
-			if err := cache.Store(); err != nil {
-				return nil, emperror.Wrapf(err, "cannot store cache %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
-			}
+		// failed derivatives are not created again before the next try
+		failure, active := mh.activeFailure(collection, signature, action, paramstr)
+		if active {
+			return nil, &FailureError{Failure: failure}
 		}
+		// identical requests wait for the first one
+		key := cacheKey(collection, signature, action, paramstr)
+		cache, err = mh.coalesce.Do(key, func() (*database.Cache, error) {
+			return mh.withLock(collection, signature, action, paramstr, func() (*database.Cache, error) {
+				// could have been created after the cache miss
+				cache, err := mh.mdb.GetCache(collection, signature, action, paramstr)
+				if err != database.ErrNotFound {
+					return cache, err
+				}
+				cache, err = mh.createCache(collection, signature, action, paramstr, params)
+				// the derivative is created again from the new version of the master
+				if err == errMasterChanged {
+					cache, err = mh.createCache(collection, signature, action, paramstr, params)
+				}
+				if err != nil {
+					return nil, mh.recordFailure(collection, signature, action, paramstr, err)
+				}
+				if failure != nil {
+					if err := failure.Delete(); err != nil {
+						mh.log.Errorf("cannot delete failure of %s: %v", key, err)
+					}
+				}
+				return cache, nil
+			})
+		})
+	}
+	if _, ok := err.(*FailureError); ok {
+		return nil, err
 	}
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot get cache for %s/%s/%s/%s", collection, signature, action, paramstr)
@@ -238,6 +388,155 @@ func (mh *MediaHandler) GetCache(collection, signature, action, paramstr string)
 	return cache, err
 }
 
+/*
+resolveCaptionField replaces the field parameter of a caption with the text of the metadata field.
+the text becomes part of the cache key, so that changed metadata results in a new caption
+*/
+func (mh *MediaHandler) resolveCaptionField(collection, signature, paramstr string) (string, error) {
+	params := strings.Split(paramstr, "/")
+	var fieldIdx = -1
+	for i, param := range params {
+		param = strings.ToLower(param)
+		if strings.HasPrefix(param, "text") {
+			// text has precedence
+			return paramstr, nil
+		}
+		if strings.HasPrefix(param, "field") {
+			fieldIdx = i
+		}
+	}
+	if fieldIdx < 0 {
+		return paramstr, nil
+	}
+	cache, err := mh.GetCache(collection, signature, "master", "")
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot get master %s/%s", collection, signature)
+	}
+	master, err := cache.GetMaster()
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	text, err := media.CaptionField(master.Metadata, strings.ToLower(params[fieldIdx])[len("field"):])
+	if err != nil {
+		return "", err
+	}
+	params[fieldIdx] = "text" + hex.EncodeToString([]byte(text))
+	return strings.Join(params, "/"), nil
+}
+
+// createCache ingests the master or creates the derivative
+func (mh *MediaHandler) createCache(collection, signature, action, paramstr string, params map[string]string) (*database.Cache, error) {
+	// master with parameters is a derivative of the ingested master
+	if action == "master" && paramstr == "" {
+		master, cache, err := mh.ingestMaster(collection, signature)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot ingest master %s/%s", collection, signature)
+		}
+		mh.log.Infof("master: %v // %v", master, cache)
+		return mh.mdb.GetCache(collection, signature, action, paramstr)
+	}
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	stor, err := coll.GetStorage()
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get storage #%v from collection %s", coll.StorageId, collection)
+	}
+	master, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	// derivatives are not created from an outdated version of the master
+	if changed, err := mh.MasterChanged(master, false); err != nil {
+		mh.log.Warningf("cannot check master %s/%s: %v", collection, signature, err)
+	} else if changed {
+		mh.log.Infof("master %s/%s has changed", collection, signature)
+		if err := mh.invalidateChanged(collection, signature); err != nil {
+			return nil, emperror.Wrapf(err, "cannot invalidate master %s/%s", collection, signature)
+		}
+		if master, err = mh.mdb.GetMaster(coll, signature); err != nil {
+			return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+		}
+	}
+	act, ok := mh.action[master.Type]
+	// text recognition does not depend on the master type
+	if action == "ocr" && mh.ocr != nil {
+		act, ok = mh.ocr, true
+	}
+	if !ok {
+		return nil, media.NewParamError("no derivatives for type %s of %s/%s", master.Type, collection, signature)
+	}
+	mastercache, err := mh.GetCache(collection, signature, "master", "")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get master cache of %s/%s", collection, signature)
+	}
+	source := mastercache
+	// office documents are rendered from their pdf conversion
+	if master.Type == "office" && action != "pdf" {
+		if source, err = mh.GetCache(collection, signature, "pdf", ""); err != nil {
+			return nil, emperror.Wrapf(err, "cannot convert %s/%s to pdf", collection, signature)
+		}
+	}
+	file, _, err := mh.FileOpenRead(source.Path, filesystem.FileGetOptions{})
+	// the ingested master is missing
+	if err != nil && source == mastercache {
+		if missing, _, serr := mh.checkCache(source); serr == nil && missing {
+			mh.log.Warningf("file %s of master %s/%s is missing", source.Path, collection, signature)
+			var repaired *database.Cache
+			if repaired, err = mh.repairCache(source, true); err == nil {
+				source, mastercache = repaired, repaired
+				file, _, err = mh.FileOpenRead(source.Path, filesystem.FileGetOptions{})
+			}
+		}
+	}
+	if err != nil {
+		return nil, emperror.Wrapf(err, "open master cache file %s of %s/%s", source.Path, collection, signature)
+	}
+	defer file.Close()
+	filename := buildFilename(coll, master, action, paramstr)
+	bucket, err := stor.GetBucket()
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get bucket from stor %s - %s", stor.Name, stor.Filebase)
+	}
+	cm, err := act.Do(master, action, params, bucket, filename, file)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
+	}
+	cache, err := database.NewCache(
+		mh.mdb,
+		0,
+		coll.Id,
+		master.Id,
+		action,
+		paramstr,
+		cm.Mimetype,
+		cm.Size,
+		fmt.Sprintf("%s/%s", stor.Filebase, filename),
+		cm.Width,
+		cm.Height,
+		cm.Duration)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create cache %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
+	}
+	if err := cache.Store(); err != nil {
+		return nil, emperror.Wrapf(err, "cannot store cache %s/%s/%s/%s", coll.Name, master.Signature, action, paramstr)
+	}
+	// the master could have been invalidated during the creation
+	if current, err := mh.mdb.GetCacheByMaster(master, "master", ""); err != nil || current.Id != mastercache.Id {
+		if err := mh.removeCache(cache); err != nil {
+			mh.log.Errorf("cannot remove outdated cache %s/%s/%s/%s: %v", coll.Name, master.Signature, action, paramstr, err)
+		}
+		return nil, errMasterChanged
+	}
+	if isOCRText(action, params) {
+		if err := mh.storeOCRText(coll, signature, cache); err != nil {
+			mh.log.Errorf("cannot store text of %s/%s: %v", collection, signature, err)
+		}
+	}
+	return cache, nil
+}
+
 func (mh *MediaHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
@@ -257,22 +556,91 @@ func (mh *MediaHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	paramstr, _ := vars["paramstr"]
-	params := strings.Split(strings.ToLower(paramstr), "/")
-	sort.Strings(params)
+
+	// presets share the cache entries of their action
+	if action == "preset" {
+		presetAction, presetParams, err := mh.resolvePreset(collection, paramstr)
+		if err != nil {
+			mh.DoPanicf(resp, http.StatusNotFound, "cannot resolve preset %s: %v", false, paramstr, err)
+			return
+		}
+		action, paramstr = presetAction, presetParams
+	}
+	if action == "srcset" {
+		mh.ServeSrcset(resp, req, collection, signature, paramstr)
+		return
+	}
+	if action == "dzi" || action == "zoomify" {
+		mh.ServeTiles(resp, req, collection, signature, action, paramstr)
+		return
+	}
+	if action == "xyz" {
+		mh.ServeGeoTiles(resp, req, collection, signature, paramstr)
+		return
+	}
+	if action == "resize" {
+		resp.Header().Set("Accept-CH", "Sec-CH-Width, Sec-CH-DPR")
+		resp.Header().Set("Vary", "Sec-CH-Width, Sec-CH-DPR")
+		paramstr = mh.applyClientHints(req, collection, signature, action, paramstr)
+	}
+	// parameters are not case sensitive, so caption text is hex encoded
+	if text := req.URL.Query().Get("text"); action == "caption" && text != "" {
+		paramstr = strings.Trim(paramstr+"/text"+hex.EncodeToString([]byte(text)), "/")
+	}
+
+	// expensive derivatives are created by the job queue
+	if mh.jobs != nil && mh.jobs.IsAsync(action) && mh.serveAsync(resp, req, collection, signature, action, paramstr) {
+		return
+	}
 
 	cache, err := mh.GetCache(collection, signature, action, paramstr)
+	// svg masters could contain scripts and are never delivered without sanitizing
+	if err == nil && action == "master" && cache.Params == "" && cache.Mimetype == "image/svg+xml" {
+		cache, err = mh.GetCache(collection, signature, action, "sanitize")
+	}
+	if fe, ok := err.(*FailureError); ok {
+		mh.serveFailure(resp, req, fe.Failure)
+		return
+	}
 	switch err {
 	case nil:
+		if mh.access != nil {
+			mh.access.Hit(cache.Id)
+		}
 		resp.Header().Set("Content-type", cache.Mimetype)
-		mh.ServeContent(resp, req, cache.Path)
+		if cache.Mimetype == "image/svg+xml" {
+			resp.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+		}
+		mh.ServeCache(resp, req, cache)
 		return
 	default:
-		mh.DoPanicf(resp, http.StatusBadRequest, "could not load cache for %s/%s/%s/%s", false, collection, signature, action, paramstr)
+		status := http.StatusInternalServerError
+		if media.IsParamError(err) {
+			status = http.StatusBadRequest
+		} else if isNotFound(err) {
+			status = http.StatusNotFound
+		}
+		mh.DoPanicf(resp, status, "could not load cache for %s/%s/%s/%s: %v", false, collection, signature, action, paramstr, err)
 		return
 	}
 }
 
+// isNotFound checks, whether err is caused by a missing database entry like an unknown collection or master
+func isNotFound(err error) bool {
+	var found bool
+	emperror.ForEachCause(err, func(err error) bool {
+		found = err == database.ErrNotFound
+		return !found
+	})
+	return found
+}
+
 func (mh *MediaHandler) SetRoutes(router *mux.Router) error {
+	router.HandleFunc(fmt.Sprintf("/%s/job/{jobid:[0-9]+}", mh.prefix), mh.ServeJob).Methods("GET", "HEAD")
+	router.HandleFunc(fmt.Sprintf("/%s/invalidate/{collection}/{signature}", mh.prefix), mh.ServeInvalidate).Methods("POST")
+	router.HandleFunc(fmt.Sprintf("/%s/invalidate/{collection}", mh.prefix), mh.ServeInvalidate).Methods("POST")
+	router.HandleFunc(fmt.Sprintf("/%s/failures", mh.prefix), mh.ServeFailures).Methods("GET")
+	router.HandleFunc(fmt.Sprintf("/%s/failures/{collection}", mh.prefix), mh.ServeFailures).Methods("GET")
 	path := regexp.MustCompile(fmt.Sprintf("/%s/(?P<collection>[^/]+)/(?P<signature>[^/]+)/(?P<action>[^/]+)(/(?P<paramstr>.+))?$", mh.prefix))
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := path.FindStringSubmatch(request.URL.Path)
@@ -332,6 +700,15 @@ func (mh *MediaHandler) ingestMaster(collection, signature string) (*database.Ma
 	if err != nil {
 		return nil, nil, emperror.Wrapf(err, "cannot get type for %s", filename)
 	}
+	master.Mimetype = media.RawMimetype(master.Mimetype, master.Urn)
+	// raw files are often identified as generic tiff or binary data
+	if media.IsRawMimetype(master.Mimetype) {
+		master.Type, master.Subtype = "image", "raw"
+	}
+	format := containerFormat(master.Mimetype, master.Urn)
+	if format != "" {
+		master.Type = "archive"
+	}
 	master.Sha256 = header.GetSHA256()
 
 	width, height, duration, mimetype, sub, meta, err := mh.idx.GetMetadata(filename, master.Type, master.Subtype, master.Mimetype)
@@ -363,11 +740,28 @@ func (mh *MediaHandler) ingestMaster(collection, signature string) (*database.Ma
 		return nil, nil, emperror.Wrapf(err, "cannot store master cache for %s/%s", coll.Name, master.Signature)
 	}
 
+	// members become child masters, nested containers are not unpacked
+	if format != "" && master.ParentId == 0 {
+		members, err := mh.unpackContainer(coll, storage, master, filename, format)
+		if err != nil {
+			// the container is not ingested without its members
+			if err := mh.removeCache(cache); err != nil {
+				mh.log.Errorf("cannot remove master cache of %s/%s: %v", coll.Name, master.Signature, err)
+			}
+			return nil, nil, emperror.Wrapf(err, "cannot unpack container %s/%s", coll.Name, master.Signature)
+		}
+		metadata["members"] = members
+	}
+
 	master.Metadata = metadata
 	master.Subtype = sub
+	master.Error = ""
 
 	if err := master.Store(); err != nil {
 		return nil, nil, emperror.Wrapf(err, "cannot store master %s", master.Signature)
 	}
+
+	mh.startWarmup(coll, master)
+
 	return master, cache, nil
 }
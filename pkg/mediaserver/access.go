@@ -0,0 +1,86 @@
+package mediaserver
+
+import (
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/op/go-logging"
+	"sync"
+	"time"
+)
+
+/*
+AccessRecorder counts the delivery of cache entries in memory. lastaccess and hits of the
+cache table are updated in batches, so that requests do not wait for the database
+*/
+type AccessRecorder struct {
+	mdb   *database.MediaDatabase
+	log   *logging.Logger
+	mutex sync.Mutex
+	hits  map[int64]int64
+	end   chan bool
+	done  chan bool
+}
+
+func NewAccessRecorder(mdb *database.MediaDatabase, log *logging.Logger) (*AccessRecorder, error) {
+	ar := &AccessRecorder{
+		mdb:  mdb,
+		log:  log,
+		hits: make(map[int64]int64),
+		end:  make(chan bool),
+		done: make(chan bool),
+	}
+	return ar, nil
+}
+
+// Hit records one delivery of cache entry cacheid
+func (ar *AccessRecorder) Hit(cacheid int64) {
+	ar.mutex.Lock()
+	ar.hits[cacheid]++
+	ar.mutex.Unlock()
+}
+
+// Flush writes the recorded hits to the database. on error they are kept for the next flush
+func (ar *AccessRecorder) Flush() error {
+	ar.mutex.Lock()
+	hits := ar.hits
+	ar.hits = make(map[int64]int64)
+	ar.mutex.Unlock()
+
+	if err := ar.mdb.UpdateCacheAccess(hits); err != nil {
+		ar.mutex.Lock()
+		for id, count := range hits {
+			ar.hits[id] += count
+		}
+		ar.mutex.Unlock()
+		return emperror.Wrapf(err, "cannot update access of %v cache entries", len(hits))
+	}
+	return nil
+}
+
+// Start flushes the hits every interval until Stop is called
+func (ar *AccessRecorder) Start(interval time.Duration) {
+	go func() {
+		defer close(ar.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ar.Flush(); err != nil {
+					ar.log.Errorf("cannot flush cache access: %v", err)
+				}
+			case <-ar.end:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background flush and writes the remaining hits
+func (ar *AccessRecorder) Stop() {
+	close(ar.end)
+	<-ar.done
+	if err := ar.Flush(); err != nil {
+		ar.log.Errorf("cannot flush cache access: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"sync"
+)
+
+type coalesceCall struct {
+	wg    sync.WaitGroup
+	cache *database.Cache
+	err   error
+}
+
+/*
+coalescer runs only one creation per key at the same time. concurrent callers with the same key
+wait and get the result of the running creation
+*/
+type coalescer struct {
+	mutex sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+func (c *coalescer) Do(key string, fn func() (*database.Cache, error)) (*database.Cache, error) {
+	c.mutex.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalesceCall)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		call.wg.Wait()
+		return call.cache, call.err
+	}
+	// waiters get an error, if fn panics
+	call := &coalesceCall{err: fmt.Errorf("creation of %s aborted", key)}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		call.wg.Done()
+	}()
+	call.cache, call.err = fn()
+	return call.cache, call.err
+}
@@ -0,0 +1,265 @@
+package mediaserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// protection against archive bombs
+const (
+	containerMaxMembers    = 10000
+	containerMaxMemberSize = 4 << 30
+	containerMaxSize       = 16 << 30
+)
+
+type ContainerMember struct {
+	Path      string `json:"path"`
+	Signature string `json:"signature"`
+	Size      int64  `json:"size"`
+	Error     string `json:"error,omitempty"`
+}
+
+// returns zip, tar, tgz or an empty string, if mimetype is no container
+func containerFormat(mimetype, urn string) string {
+	switch strings.ToLower(mimetype) {
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	case "application/x-tar", "application/tar":
+		return "tar"
+	case "application/gzip", "application/x-gzip", "application/x-gtar":
+		lower := strings.ToLower(urn)
+		if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+			return "tgz"
+		}
+	}
+	return ""
+}
+
+// signature of a member is derived from the signature of the container and the path within
+func childSignature(parent *database.Master, name string) string {
+	return strings.ToLower(parent.Signature + "!" + strings.ReplaceAll(name, "/", "!"))
+}
+
+// cleans member name. returns an empty string for entries which are not unpacked (hidden files, resource forks)
+func containerMemberName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return ""
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return ""
+		}
+	}
+	return name
+}
+
+// calls fn for every regular file in the container
+func (mh *MediaHandler) walkContainer(filename, format string, fn func(name string, size int64, reader io.Reader) error) error {
+	switch format {
+	case "zip":
+		// zip needs random access
+		local, cleanup, err := mh.localCopy(filename)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		zr, err := zip.OpenReader(local)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot open zip %s", filename)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return emperror.Wrapf(err, "cannot open %s in %s", f.Name, filename)
+			}
+			err = fn(f.Name, int64(f.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "tar", "tgz":
+		reader, _, err := mh.FileOpenRead(filename, filesystem.FileGetOptions{})
+		if err != nil {
+			return emperror.Wrapf(err, "cannot open %s", filename)
+		}
+		defer reader.Close()
+		var r io.Reader = reader
+		if format == "tgz" {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				return emperror.Wrapf(err, "cannot decompress %s", filename)
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return emperror.Wrapf(err, "cannot read tar %s", filename)
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			if err := fn(hdr.Name, hdr.Size, tr); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid container format %s", format)
+	}
+}
+
+/*
+unpackContainer registers every member of a container as child master and ingests it.
+members which cannot be ingested are listed with their error, the child master keeps the error as well
+*/
+func (mh *MediaHandler) unpackContainer(coll *database.Collection, storage *database.Storage, parent *database.Master, filename, format string) ([]ContainerMember, error) {
+	var members []ContainerMember
+	// signature => path of the member
+	var signatures = map[string]string{}
+	var total int64
+	err := mh.walkContainer(filename, format, func(name string, size int64, reader io.Reader) error {
+		name = containerMemberName(name)
+		if name == "" {
+			return nil
+		}
+		if len(members) >= containerMaxMembers {
+			return fmt.Errorf("more than %v members in container", containerMaxMembers)
+		}
+		member := ContainerMember{
+			Path:      name,
+			Signature: childSignature(parent, name),
+			Size:      size,
+		}
+		if other, ok := signatures[member.Signature]; ok {
+			member.Error = fmt.Sprintf("signature %s is already used by %s", member.Signature, other)
+			mh.log.Errorf("cannot add member %s of %s/%s: %s", name, coll.Name, parent.Signature, member.Error)
+			members = append(members, member)
+			return nil
+		}
+		signatures[member.Signature] = name
+		if size < 0 || size > containerMaxMemberSize {
+			return fmt.Errorf("member %s has invalid size %v", name, size)
+		}
+		if total += size; total > containerMaxSize {
+			return fmt.Errorf("more than %v bytes in container", containerMaxSize)
+		}
+		// the size in the header is not trusted, the member is never read beyond it
+		if err := mh.addChild(coll, storage, parent, member.Signature, path.Ext(name), io.LimitReader(reader, size), size); err != nil {
+			mh.log.Errorf("cannot add member %s of %s/%s: %v", name, coll.Name, parent.Signature, err)
+			member.Error = err.Error()
+		}
+		members = append(members, member)
+		return nil
+	})
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot unpack %s", filename)
+	}
+	// members of a former version, which are not in the container anymore
+	if err := mh.mdb.GetChildSignatures(parent, func(signature string) error {
+		if _, ok := signatures[signature]; !ok {
+			if err := mh.removeChild(coll, signature); err != nil {
+				mh.log.Errorf("cannot remove member %s/%s: %v", coll.Name, signature, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, emperror.Wrapf(err, "cannot list former members of %s/%s", coll.Name, parent.Signature)
+	}
+	return members, nil
+}
+
+// removeChild deletes the file and all derivatives of a former member. the master remains with an error
+func (mh *MediaHandler) removeChild(coll *database.Collection, signature string) error {
+	child, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot load master %s/%s", coll.Name, signature)
+	}
+	if _, err := mh.dropMaster(coll, child); err != nil {
+		return err
+	}
+	if fs, bucket, path, err := mh.GetFS(child.Urn); err != nil {
+		mh.log.Warningf("member %s/%s has no valid path: %v", coll.Name, signature, err)
+	} else if err := fs.FileDelete(bucket, path); err != nil && !filesystem.IsNotFoundError(err) {
+		return emperror.Wrapf(err, "cannot delete %s", child.Urn)
+	}
+	child.Type = "none"
+	child.Error = "not a member of the container anymore"
+	if err := child.Store(); err != nil {
+		return emperror.Wrapf(err, "cannot store master %s/%s", coll.Name, signature)
+	}
+	return nil
+}
+
+/*
+addChild writes the member and ingests it as child master. members of a former ingest are
+invalidated, if their content has changed or they were invalidated with the container
+*/
+func (mh *MediaHandler) addChild(coll *database.Collection, storage *database.Storage, parent *database.Master, signature, ext string, reader io.Reader, size int64) error {
+	child, err := mh.mdb.GetMaster(coll, signature)
+	switch {
+	case err == database.ErrNotFound:
+		child = nil
+	case err != nil:
+		return emperror.Wrapf(err, "cannot check master %s/%s", coll.Name, signature)
+	case child.ParentId != parent.Id:
+		return fmt.Errorf("signature %s/%s is used by another master", coll.Name, signature)
+	}
+	// the extension is kept for type detection
+	urn := storage.Filebase
+	urn += "/" + filepath.Join(storage.SubmasterDir, buildFilename(coll, parent, "member", signature)+strings.ToLower(ext))
+	if child != nil {
+		urn = child.Urn
+	}
+	h := sha256.New()
+	if err := mh.FileWrite(urn, io.TeeReader(reader, h), size, filesystem.FilePutOptions{}); err != nil {
+		return emperror.Wrapf(err, "cannot write member %s", urn)
+	}
+	if child != nil {
+		if strings.EqualFold(child.Sha256, hex.EncodeToString(h.Sum(nil))) {
+			if _, err := mh.mdb.GetCacheByMaster(child, "master", ""); err == nil {
+				return nil
+			}
+		}
+		if err := mh.InvalidateMaster(coll.Name, signature); err != nil {
+			return emperror.Wrapf(err, "cannot refresh master %s/%s", coll.Name, signature)
+		}
+		return nil
+	}
+	child, err = mh.mdb.CreateMaster(coll, signature, urn, parent)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot create master %s/%s", coll.Name, signature)
+	}
+	if _, _, err := mh.ingestMaster(coll.Name, signature); err != nil {
+		child.Type = "none"
+		child.Error = err.Error()
+		if err2 := child.Store(); err2 != nil {
+			mh.log.Errorf("cannot store error of master %s/%s: %v", coll.Name, signature, err2)
+		}
+		return emperror.Wrapf(err, "cannot ingest master %s/%s", coll.Name, signature)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package mediaserver
+
+import (
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"time"
+)
+
+type DCRaw struct {
+	dcraw string
+	mh    *MediaHandler
+}
+
+func NewDCRaw(mh *MediaHandler, command string) (*DCRaw, error) {
+	dr := &DCRaw{
+		dcraw: command, mh: mh,
+	}
+	return dr, nil
+}
+
+func (dr *DCRaw) SetMediaHandler(mh *MediaHandler) {
+	dr.mh = mh
+}
+
+func (dr *DCRaw) GetMetadata(filename string, timeout time.Duration) (*media.RawInfo, error) {
+	// dcraw needs a seekable file
+	fname, cleanup, err := dr.mh.localCopy(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	info, err := media.GetRawInfo(dr.dcraw, fname, timeout)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot identify raw image %s", filename)
+	}
+	return info, nil
+}
@@ -0,0 +1,127 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/op/go-logging"
+	"strings"
+	"time"
+)
+
+// number of derivatives, which are loaded at once for eviction
+const evictionBatchSize = 100
+
+/*
+Evictor removes derivatives of storages, which exceed their quota (bytes per storage name).
+masters are never removed. derivatives are recreated on the next request.
+tiles are written below the submaster folder without cache entry. the filesystems cannot list them,
+so they are neither counted nor evicted, but removed with their master
+*/
+type Evictor struct {
+	mh     *MediaHandler
+	mdb    *database.MediaDatabase
+	quotas map[string]int64
+	lfu    bool
+	log    *logging.Logger
+	end    chan bool
+}
+
+// strategy is lru (least recently used) or lfu (least frequently used)
+func NewEvictor(mh *MediaHandler, mdb *database.MediaDatabase, quotas map[string]int64, strategy string, log *logging.Logger) (*Evictor, error) {
+	ev := &Evictor{
+		mh:     mh,
+		mdb:    mdb,
+		quotas: make(map[string]int64),
+		log:    log,
+		end:    make(chan bool),
+	}
+	switch strings.ToLower(strategy) {
+	case "", "lru":
+	case "lfu":
+		ev.lfu = true
+	default:
+		return nil, fmt.Errorf("invalid eviction strategy %s", strategy)
+	}
+	for name, quota := range quotas {
+		ev.quotas[strings.ToLower(name)] = quota
+	}
+	return ev, nil
+}
+
+// Evict checks all storages with quota
+func (ev *Evictor) Evict() error {
+	var storages []*database.Storage
+	if err := ev.mdb.GetStorages(func(storage *database.Storage) error {
+		if _, ok := ev.quotas[strings.ToLower(storage.Name)]; ok {
+			storages = append(storages, storage)
+		}
+		return nil
+	}); err != nil {
+		return emperror.Wrap(err, "cannot load storages")
+	}
+	for _, storage := range storages {
+		num, size, err := ev.EvictStorage(storage, ev.quotas[strings.ToLower(storage.Name)])
+		if err != nil {
+			return emperror.Wrapf(err, "cannot evict derivatives of storage %s", storage.Name)
+		}
+		if num > 0 {
+			ev.log.Infof("storage %s: %v derivatives with %v bytes evicted", storage.Name, num, size)
+		}
+	}
+	return nil
+}
+
+// EvictStorage removes derivatives until the usage of storage is below quota
+func (ev *Evictor) EvictStorage(storage *database.Storage, quota int64) (num int64, size int64, err error) {
+	usage, err := ev.mdb.GetCacheUsage(storage)
+	if err != nil {
+		return 0, 0, emperror.Wrapf(err, "cannot get usage of storage %s", storage.Name)
+	}
+	for usage > quota {
+		var removed int64
+		if err := ev.mdb.GetEvictionCandidates(storage, ev.lfu, evictionBatchSize, func(cache *database.Cache) error {
+			if usage <= quota {
+				return nil
+			}
+			if err := ev.mh.removeCache(cache); err != nil {
+				ev.log.Errorf("cannot evict cache #%v %s: %v", cache.Id, cache.Path, err)
+				return nil
+			}
+			usage -= cache.Filesize
+			size += cache.Filesize
+			num++
+			removed++
+			return nil
+		}); err != nil {
+			return num, size, emperror.Wrapf(err, "cannot get eviction candidates of storage %s", storage.Name)
+		}
+		// nothing left, which could be removed
+		if removed == 0 {
+			break
+		}
+	}
+	return num, size, nil
+}
+
+// Start runs the eviction every interval until Stop is called
+func (ev *Evictor) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ev.Evict(); err != nil {
+				ev.log.Errorf("eviction failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ev.end:
+				return
+			}
+		}
+	}()
+}
+
+func (ev *Evictor) Stop() {
+	close(ev.end)
+}
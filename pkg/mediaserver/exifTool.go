@@ -0,0 +1,286 @@
+package mediaserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+EmbeddedMetadata is the normalized form of EXIF, IPTC and XMP data embedded in a master.
+The schema is independent of the tool used for extraction, so downstream catalogues can rely on it.
+*/
+type EmbeddedMetadata struct {
+	Camera   *EmbeddedCamera  `json:"camera,omitempty"`
+	Capture  *EmbeddedCapture `json:"capture,omitempty"`
+	GPS      *EmbeddedGPS     `json:"gps,omitempty"`
+	Creator  []string         `json:"creator,omitempty"`
+	Title    string           `json:"title,omitempty"`
+	Caption  string           `json:"caption,omitempty"`
+	Keywords []string         `json:"keywords,omitempty"`
+	Rights   string           `json:"rights,omitempty"`
+	Credit   string           `json:"credit,omitempty"`
+	Source   string           `json:"source,omitempty"`
+	Location *EmbeddedPlace   `json:"location,omitempty"`
+}
+
+type EmbeddedCamera struct {
+	Make     string `json:"make,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Lens     string `json:"lens,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Software string `json:"software,omitempty"`
+}
+
+type EmbeddedCapture struct {
+	Date         string  `json:"date,omitempty"` // ISO 8601
+	ExposureTime float64 `json:"exposuretime,omitempty"`
+	FNumber      float64 `json:"fnumber,omitempty"`
+	ISO          float64 `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focallength,omitempty"`
+}
+
+type EmbeddedGPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+type EmbeddedPlace struct {
+	Sublocation string `json:"sublocation,omitempty"`
+	City        string `json:"city,omitempty"`
+	State       string `json:"state,omitempty"`
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"countrycode,omitempty"`
+}
+
+type ExifTool struct {
+	exiftool string
+	mh       *MediaHandler
+}
+
+func NewExifTool(mh *MediaHandler, command string) (*ExifTool, error) {
+	et := &ExifTool{
+		exiftool: command, mh: mh,
+	}
+	return et, nil
+}
+
+func (et *ExifTool) SetMediaHandler(mh *MediaHandler) {
+	et.mh = mh
+}
+
+// exiftool result with group prefixes (-G) and numerical values (-n)
+type exifToolResult map[string]interface{}
+
+// json numbers are float64, %v would use scientific notation for large values like serial numbers
+func exifString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v", v))
+}
+
+// first non-empty string value of keys
+func (etr exifToolResult) str(keys ...string) string {
+	for _, key := range keys {
+		switch val := etr[key].(type) {
+		case string:
+			if val = strings.TrimSpace(val); val != "" {
+				return val
+			}
+		case float64:
+			return exifString(val)
+		case []interface{}:
+			if len(val) > 0 {
+				return exifString(val[0])
+			}
+		}
+	}
+	return ""
+}
+
+// all distinct string values of keys, lists are flattened
+func (etr exifToolResult) list(keys ...string) []string {
+	var result []string
+	var found = map[string]bool{}
+	add := func(v interface{}) {
+		str := exifString(v)
+		if str != "" && !found[strings.ToLower(str)] {
+			found[strings.ToLower(str)] = true
+			result = append(result, str)
+		}
+	}
+	for _, key := range keys {
+		switch val := etr[key].(type) {
+		case nil:
+		case []interface{}:
+			for _, v := range val {
+				add(v)
+			}
+		default:
+			add(val)
+		}
+	}
+	return result
+}
+
+// first list which is not empty, to keep priority between the different standards
+func (etr exifToolResult) firstList(keys ...string) []string {
+	for _, key := range keys {
+		if l := etr.list(key); len(l) > 0 {
+			return l
+		}
+	}
+	return nil
+}
+
+func (etr exifToolResult) num(keys ...string) (float64, bool) {
+	for _, key := range keys {
+		if val, ok := etr[key].(float64); ok {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+// converts exif date "2006:01:02 15:04:05" to iso 8601
+func isoDate(date, offset string) string {
+	date = strings.TrimSpace(date)
+	if date == "" || strings.HasPrefix(date, "0000") {
+		return ""
+	}
+	for _, layout := range []string{"2006:01:02 15:04:05-07:00", "2006:01:02 15:04:05Z07:00", "2006:01:02 15:04:05", "2006:01:02 15:04", "2006:01:02"} {
+		t, err := time.Parse(layout, date)
+		if err != nil {
+			continue
+		}
+		switch layout {
+		case "2006:01:02 15:04:05", "2006:01:02 15:04":
+			if offset != "" {
+				if t2, err := time.Parse("2006-01-02T15:04:05-07:00", t.Format("2006-01-02T15:04:05")+offset); err == nil {
+					return t2.Format(time.RFC3339)
+				}
+			}
+			return t.Format("2006-01-02T15:04:05")
+		case "2006:01:02":
+			return t.Format("2006-01-02")
+		default:
+			return t.Format(time.RFC3339)
+		}
+	}
+	return date
+}
+
+func (etr exifToolResult) normalize() *EmbeddedMetadata {
+	em := &EmbeddedMetadata{}
+
+	camera := &EmbeddedCamera{
+		Make:     etr.str("EXIF:Make", "XMP:Make"),
+		Model:    etr.str("EXIF:Model", "XMP:Model"),
+		Lens:     etr.str("EXIF:LensModel", "XMP:LensModel", "XMP:Lens", "Composite:LensID"),
+		Serial:   etr.str("EXIF:SerialNumber", "MakerNotes:SerialNumber", "XMP:SerialNumber"),
+		Software: etr.str("EXIF:Software", "XMP:CreatorTool"),
+	}
+	if *camera != (EmbeddedCamera{}) {
+		em.Camera = camera
+	}
+
+	capture := &EmbeddedCapture{}
+	if date := etr.str("EXIF:DateTimeOriginal", "EXIF:CreateDate"); date != "" {
+		capture.Date = isoDate(date, etr.str("EXIF:OffsetTimeOriginal", "EXIF:OffsetTime"))
+	} else if date := etr.str("XMP:DateTimeOriginal", "XMP:DateCreated", "Composite:DateTimeCreated", "IPTC:DateCreated"); date != "" {
+		capture.Date = isoDate(date, "")
+	}
+	capture.ExposureTime, _ = etr.num("EXIF:ExposureTime")
+	capture.FNumber, _ = etr.num("EXIF:FNumber")
+	capture.ISO, _ = etr.num("EXIF:ISO")
+	capture.FocalLength, _ = etr.num("EXIF:FocalLength")
+	if *capture != (EmbeddedCapture{}) {
+		em.Capture = capture
+	}
+
+	// composite values are signed decimal degrees because of -n
+	lat, latOk := etr.num("Composite:GPSLatitude", "XMP:GPSLatitude")
+	lon, lonOk := etr.num("Composite:GPSLongitude", "XMP:GPSLongitude")
+	if latOk && lonOk {
+		em.GPS = &EmbeddedGPS{Latitude: lat, Longitude: lon}
+		if alt, ok := etr.num("Composite:GPSAltitude", "EXIF:GPSAltitude"); ok {
+			em.GPS.Altitude = &alt
+		}
+	}
+
+	em.Creator = etr.firstList("XMP:Creator", "IPTC:By-line", "EXIF:Artist")
+	em.Title = etr.str("XMP:Title", "IPTC:ObjectName")
+	em.Caption = etr.str("XMP:Description", "IPTC:Caption-Abstract", "EXIF:ImageDescription")
+	em.Keywords = etr.list("XMP:Subject", "IPTC:Keywords")
+	em.Rights = etr.str("XMP:Rights", "IPTC:CopyrightNotice", "EXIF:Copyright")
+	em.Credit = etr.str("XMP:Credit", "IPTC:Credit")
+	em.Source = etr.str("XMP:Source", "IPTC:Source")
+
+	place := &EmbeddedPlace{
+		Sublocation: etr.str("XMP:Location", "IPTC:Sub-location"),
+		City:        etr.str("XMP:City", "IPTC:City"),
+		State:       etr.str("XMP:State", "IPTC:Province-State"),
+		Country:     etr.str("XMP:Country", "IPTC:Country-PrimaryLocationName"),
+		CountryCode: etr.str("XMP:CountryCode", "IPTC:Country-PrimaryLocationCode"),
+	}
+	if *place != (EmbeddedPlace{}) {
+		em.Location = place
+	}
+	return em
+}
+
+func (et *ExifTool) GetMetadata(filename string, timeout time.Duration) (*EmbeddedMetadata, error) {
+	fs, bucket, path, err := et.mh.GetFS(filename)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get filesystem for %s", filename)
+	}
+
+	cmdparam := []string{"-json", "-G", "-n", "-charset", "iptc=UTF8"}
+	var stdin io.Reader
+	if fs.IsLocal() {
+		u, err := fs.GETUrl(bucket, path, timeout)
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot get url for %s", filename)
+		}
+		cmdparam = append(cmdparam, u.Path)
+	} else {
+		reader, _, err := fs.FileOpenRead(bucket, path, filesystem.FileGetOptions{})
+		if err != nil {
+			return nil, emperror.Wrapf(err, "cannot open %s", filename)
+		}
+		defer reader.Close()
+		stdin = reader
+		cmdparam = append(cmdparam, "-")
+	}
+
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, et.exiftool, cmdparam...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v - %v", et.exiftool, cmdparam, out.String(), errb.String())
+	}
+
+	var results []exifToolResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		return nil, emperror.Wrapf(err, "cannot unmarshall metadata: %s", out.String())
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("wrong number of objects in exiftool result list - %v", len(results))
+	}
+	return results[0].normalize(), nil
+}
@@ -0,0 +1,138 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maximum number of entries in the failure listing
+const failureListLimit = 1000
+
+// FailureError is returned for derivatives, which failed and wait for the next try
+type FailureError struct {
+	Failure *database.Failure
+}
+
+func (fe *FailureError) Error() string {
+	return fmt.Sprintf("%s/%s/%s/%s failed %v times, retry after %s: %s", fe.Failure.Collection, fe.Failure.Signature,
+		fe.Failure.Action, fe.Failure.Params, fe.Failure.Failures, fe.Failure.RetryAfter.Format(time.RFC3339), fe.Failure.Error)
+}
+
+/*
+SetFailures enables the recording of failed derivatives. they are not created again for backoff,
+which doubles with every failure up to maxBackoff. placeholder is delivered instead, if not empty
+*/
+func (mh *MediaHandler) SetFailures(backoff, maxBackoff time.Duration, placeholder string) {
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	mh.backoff = backoff
+	mh.maxBackoff = maxBackoff
+	mh.errorImage = placeholder
+}
+
+// activeFailure returns the failure of the derivative, if it waits for the next try
+func (mh *MediaHandler) activeFailure(collection, signature, action, paramstr string) (*database.Failure, bool) {
+	if mh.backoff <= 0 {
+		return nil, false
+	}
+	failure, err := mh.mdb.GetFailure(collection, signature, action, paramstr)
+	if err != nil {
+		if err != database.ErrNotFound {
+			mh.log.Errorf("cannot load failure of %s/%s/%s/%s: %v", collection, signature, action, paramstr, err)
+		}
+		return nil, false
+	}
+	return failure, failure.Active()
+}
+
+/*
+recordFailure stores the error of the derivative and returns a FailureError. errors of the ingest are
+written to the master too. invalid requests (unknown masters, parameters, which do not fit the master)
+are returned unchanged, they are no failure of the master. neither is a master, which changed again
+during the creation
+*/
+func (mh *MediaHandler) recordFailure(collection, signature, action, paramstr string, cause error) error {
+	if mh.backoff <= 0 || media.IsParamError(cause) || cause == errMasterChanged {
+		return cause
+	}
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return cause
+	}
+	master, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return cause
+	}
+	failure, err := mh.mdb.StoreFailure(collection, signature, action, paramstr, cause.Error(), mh.backoff, mh.maxBackoff)
+	if err != nil {
+		mh.log.Errorf("cannot store failure of %s/%s/%s/%s: %v", collection, signature, action, paramstr, err)
+		return cause
+	}
+	mh.log.Errorf("%s/%s/%s/%s failed %v times, next try after %s: %v", collection, signature, action, paramstr,
+		failure.Failures, failure.RetryAfter.Format(time.RFC3339), cause)
+	if action == "master" && paramstr == "" {
+		master.Error = cause.Error()
+		if err := master.Store(); err != nil {
+			mh.log.Errorf("cannot store error of master %s/%s: %v", collection, signature, err)
+		}
+	}
+	return &FailureError{Failure: failure}
+}
+
+/*
+serveFailure answers with the placeholder or with 503 and the error. Retry-After tells clients
+when the derivative is tried again
+*/
+func (mh *MediaHandler) serveFailure(resp http.ResponseWriter, req *http.Request, failure *database.Failure) {
+	retry := int64(math.Ceil(time.Until(failure.RetryAfter).Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	resp.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	resp.Header().Set("Cache-Control", "no-store")
+	if mh.errorImage != "" {
+		mh.ServeContent(resp, req, mh.errorImage)
+		return
+	}
+	mh.DoPanicf(resp, http.StatusServiceUnavailable, "creation of %s/%s/%s/%s failed: %s", false,
+		failure.Collection, failure.Signature, failure.Action, failure.Params, failure.Error)
+}
+
+/*
+ServeFailures lists the failed derivatives.
+
+	GET failures[?active=true]               all collections
+	GET failures/{collection}[?active=true]  derivatives of collection
+*/
+func (mh *MediaHandler) ServeFailures(resp http.ResponseWriter, req *http.Request) {
+	if !mh.checkAdmin(resp, req) {
+		return
+	}
+	var coll *database.Collection
+	if collection, ok := mux.Vars(req)["collection"]; ok {
+		var err error
+		if coll, err = mh.mdb.GetCollectionByName(collection); err != nil {
+			mh.DoPanicf(resp, http.StatusNotFound, "invalid collection %s: %v", true, collection, err)
+			return
+		}
+	}
+	active := req.URL.Query().Get("active") == "true"
+	failures := []*database.Failure{}
+	if err := mh.mdb.GetFailures(coll, active, failureListLimit, func(failure *database.Failure) error {
+		failures = append(failures, failure)
+		return nil
+	}); err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot list failures: %v", true, err)
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	json.NewEncoder(resp).Encode(failures)
+}
@@ -0,0 +1,48 @@
+package mediaserver
+
+import (
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"time"
+)
+
+type FFLoudness struct {
+	ffmpeg string
+	mh     *MediaHandler
+}
+
+func NewFFLoudness(mh *MediaHandler, command string) (*FFLoudness, error) {
+	fl := &FFLoudness{
+		ffmpeg: command, mh: mh,
+	}
+	return fl, nil
+}
+
+func (fl *FFLoudness) SetMediaHandler(mh *MediaHandler) {
+	fl.mh = mh
+}
+
+func (fl *FFLoudness) GetMetadata(filename string, timeout time.Duration) (*media.Loudness, error) {
+	fs, bucket, path, err := fl.mh.GetFS(filename)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get filesystem for %s", filename)
+	}
+
+	url, err := fs.GETUrl(bucket, path, timeout)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get url for %s", filename)
+	}
+
+	var fname string
+	if fs.IsLocal() {
+		fname = url.Path
+	} else {
+		fname = url.String()
+	}
+
+	loudness, err := media.AnalyzeLoudness(fl.ffmpeg, fname, nil, nil, timeout)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot analyze loudness of %s", filename)
+	}
+	return loudness, nil
+}
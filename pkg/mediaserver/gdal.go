@@ -0,0 +1,49 @@
+package mediaserver
+
+import (
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"strings"
+	"time"
+)
+
+// mimetypes, which could contain a georeference
+func isGeoCandidate(mimetype string) bool {
+	switch strings.ToLower(mimetype) {
+	case "image/tiff", "image/tiff-fx", "image/geotiff", "image/jp2":
+		return true
+	}
+	return false
+}
+
+type GDALInfo struct {
+	gdalinfo string
+	mh       *MediaHandler
+}
+
+func NewGDALInfo(mh *MediaHandler, command string) (*GDALInfo, error) {
+	gi := &GDALInfo{
+		gdalinfo: command, mh: mh,
+	}
+	return gi, nil
+}
+
+func (gi *GDALInfo) SetMediaHandler(mh *MediaHandler) {
+	gi.mh = mh
+}
+
+// GetMetadata returns the georeference of a file or nil, if there is none
+func (gi *GDALInfo) GetMetadata(filename string, timeout time.Duration) (*media.GeoInfo, error) {
+	// gdal needs a seekable file
+	fname, cleanup, err := gi.mh.localCopy(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	info, err := media.GetGeoInfo(gi.gdalinfo, fname, timeout)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get georeference of %s", filename)
+	}
+	return info, nil
+}
@@ -0,0 +1,330 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const geoTileSize = 256
+
+// local copies of remote maps are removed, if they were not used for this time
+const geoLocalExpiry = time.Hour
+
+var xyzTileRegexp = regexp.MustCompile(`^([0-9]+)/([0-9]+)/([0-9]+)\.(png|webp)$`)
+
+var wmtsTemplate = template.Must(template.New("wmts").Funcs(template.FuncMap{
+	"xml": func(str string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(str))
+		return buf.String()
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" version="1.0.0">
+  <Contents>
+    <Layer>
+      <ows:Title>{{xml .Title}}</ows:Title>
+      <ows:WGS84BoundingBox>
+        <ows:LowerCorner>{{index .Bounds 0}} {{index .Bounds 1}}</ows:LowerCorner>
+        <ows:UpperCorner>{{index .Bounds 2}} {{index .Bounds 3}}</ows:UpperCorner>
+      </ows:WGS84BoundingBox>
+      <ows:Identifier>{{xml .Title}}</ows:Identifier>
+      <Style isDefault="true"><ows:Identifier>default</ows:Identifier></Style>
+      <Format>image/png</Format>
+      <TileMatrixSetLink><TileMatrixSet>GoogleMapsCompatible</TileMatrixSet></TileMatrixSetLink>
+      <ResourceURL format="image/png" resourceType="tile" template="{{xml .URL}}/{TileMatrix}/{TileCol}/{TileRow}.png"/>
+    </Layer>
+    <TileMatrixSet>
+      <ows:Identifier>GoogleMapsCompatible</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>
+      <WellKnownScaleSet>urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible</WellKnownScaleSet>
+{{- range .Matrices}}
+      <TileMatrix>
+        <ows:Identifier>{{.Zoom}}</ows:Identifier>
+        <ScaleDenominator>{{.Scale}}</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>256</TileWidth>
+        <TileHeight>256</TileHeight>
+        <MatrixWidth>{{.Size}}</MatrixWidth>
+        <MatrixHeight>{{.Size}}</MatrixHeight>
+      </TileMatrix>
+{{- end}}
+    </TileMatrixSet>
+  </Contents>
+</Capabilities>
+`))
+
+type TileJSON struct {
+	TileJSON string     `json:"tilejson"`
+	Name     string     `json:"name"`
+	Tiles    []string   `json:"tiles"`
+	Bounds   [4]float64 `json:"bounds"`
+	Center   [3]float64 `json:"center"`
+	MinZoom  int        `json:"minzoom"`
+	MaxZoom  int        `json:"maxzoom"`
+}
+
+// reprojection of map masters is enabled with gdalwarp
+func (mh *MediaHandler) SetGeoWarper(geo *media.GeoWarper) {
+	mh.geo = geo
+}
+
+type geoSource struct {
+	coll   *database.Collection
+	master *database.Master
+	stor   *database.Storage
+	cache  *database.Cache
+	info   *media.GeoInfo
+	base   string
+}
+
+func (mh *MediaHandler) loadGeoSource(collection, signature string) (*geoSource, error) {
+	gs := &geoSource{}
+	var err error
+	if gs.coll, err = mh.mdb.GetCollectionByName(collection); err != nil {
+		return nil, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	if gs.stor, err = gs.coll.GetStorage(); err != nil {
+		return nil, emperror.Wrapf(err, "cannot get storage #%v from collection %s", gs.coll.StorageId, collection)
+	}
+	if gs.cache, err = mh.GetCache(collection, signature, "master", ""); err != nil {
+		return nil, emperror.Wrapf(err, "cannot get master of %s/%s", collection, signature)
+	}
+	if gs.master, err = mh.mdb.GetMaster(gs.coll, signature); err != nil {
+		return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	if gs.info, err = media.MasterGeoInfo(gs.master.Metadata); err != nil {
+		return nil, emperror.Wrapf(err, "%s/%s is no map", collection, signature)
+	}
+	// tiles of an older version of the master are not used
+	gs.base = tileFolder(gs.stor, gs.coll, gs.master) + "/" + buildFilename(gs.coll, gs.master, "xyz", gs.master.Sha256)
+	return gs, nil
+}
+
+/*
+localFile returns a local filename of the master, which can be read by gdal. masters on remote
+filesystems are copied to the temp folder once and reused for further tiles. copies, which were
+not used for geoLocalExpiry, are removed
+*/
+func (mh *MediaHandler) localFile(gs *geoSource) (string, error) {
+	fs, bucket, path, err := mh.GetFS(gs.cache.Path)
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot get filesystem for %s", gs.cache.Path)
+	}
+	if fs.IsLocal() {
+		u, err := fs.GETUrl(bucket, path, 0)
+		if err != nil {
+			return "", emperror.Wrapf(err, "cannot get url for %s", gs.cache.Path)
+		}
+		return u.Path, nil
+	}
+	fname := filepath.Join(mh.tempfolder, "geo-"+buildFilename(gs.coll, gs.master, "master", gs.master.Sha256))
+	if _, err := os.Stat(fname); err == nil {
+		now := time.Now()
+		os.Chtimes(fname, now, now)
+		return fname, nil
+	}
+	mh.cleanGeoFiles()
+	reader, _, err := fs.FileOpenRead(bucket, path, filesystem.FileGetOptions{})
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot open %s", gs.cache.Path)
+	}
+	defer reader.Close()
+	// concurrent requests for other tiles of the map write their own copy
+	f, err := ioutil.TempFile(mh.tempfolder, "geo-*.part")
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot create temp file for %s", fname)
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", emperror.Wrapf(err, "cannot write %s", f.Name())
+	}
+	f.Close()
+	if err := os.Rename(f.Name(), fname); err != nil {
+		os.Remove(f.Name())
+		return "", emperror.Wrapf(err, "cannot rename %s", f.Name())
+	}
+	return fname, nil
+}
+
+// cleanGeoFiles removes the local copies of maps, which were not used for geoLocalExpiry
+func (mh *MediaHandler) cleanGeoFiles() {
+	files, err := filepath.Glob(filepath.Join(mh.tempfolder, "geo-*"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > geoLocalExpiry {
+			mh.log.Infof("removing unused map copy %s", file)
+			if err := os.Remove(file); err != nil {
+				mh.log.Warningf("cannot remove %s: %v", file, err)
+			}
+		}
+	}
+}
+
+func (mh *MediaHandler) serveGeoTile(resp http.ResponseWriter, req *http.Request, gs *geoSource, z, x, y int, format string) {
+	mimetype := "image/" + format
+	if z > 24 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		mh.DoPanicf(resp, http.StatusNotFound, "invalid tile %v/%v/%v", false, z, x, y)
+		return
+	}
+	if !gs.info.Intersects(z, x, y) {
+		reader, _, err := media.EmptyTile(geoTileSize, format)
+		if err != nil {
+			mh.DoPanicf(resp, http.StatusInternalServerError, "cannot create empty tile: %v", false, err)
+			return
+		}
+		resp.Header().Set("Content-type", mimetype)
+		io.Copy(resp, reader)
+		return
+	}
+
+	path := fmt.Sprintf("%s/%d/%d/%d.%s", gs.base, z, x, y, format)
+	if err := mh.ensureGeoTile(gs, path, z, x, y, format); err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot create tile %v/%v/%v: %v", false, z, x, y, err)
+		return
+	}
+	resp.Header().Set("Content-type", mimetype)
+	mh.ServeContent(resp, req, path)
+}
+
+// ensureGeoTile renders the tile, if it does not exist yet
+func (mh *MediaHandler) ensureGeoTile(gs *geoSource, path string, z, x, y int, format string) error {
+	lock := mh.tileLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	exists := func() bool {
+		reader, _, err := mh.FileOpenRead(path, filesystem.FileGetOptions{})
+		if err != nil {
+			return false
+		}
+		reader.Close()
+		return true
+	}
+	if exists() {
+		return nil
+	}
+	// other instances could render the tile at the same time
+	if mh.locking {
+		unlock, err := mh.lockTile(path)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot lock %s", path)
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				mh.log.Errorf("cannot unlock %s: %v", path, err)
+			}
+		}()
+		if exists() {
+			return nil
+		}
+	}
+	return mh.renderGeoTile(gs, path, z, x, y, format)
+}
+
+func (mh *MediaHandler) renderGeoTile(gs *geoSource, path string, z, x, y int, format string) error {
+	fname, err := mh.localFile(gs)
+	if err != nil {
+		return err
+	}
+	reader, cm, err := mh.geo.Tile(fname, z, x, y, geoTileSize, format)
+	if err != nil {
+		return err
+	}
+	return mh.FileWrite(path, reader, cm.Size, filesystem.FilePutOptions{})
+}
+
+/*
+ServeGeoTiles delivers reprojected tiles of georeferenced maps for web maps
+
+	xyz/tile.json                    tilejson descriptor for leaflet and others
+	xyz/WMTSCapabilities.xml         restful wmts
+	xyz/<z>/<x>/<y>.<png|webp>
+*/
+func (mh *MediaHandler) ServeGeoTiles(resp http.ResponseWriter, req *http.Request, collection, signature, paramstr string) {
+	if mh.geo == nil {
+		mh.DoPanicf(resp, http.StatusNotImplemented, "no map support configured", false)
+		return
+	}
+	gs, err := mh.loadGeoSource(collection, signature)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusBadRequest, "cannot load map %s/%s: %v", false, collection, signature, err)
+		return
+	}
+	url := fmt.Sprintf("/%s/%s/%s/xyz", mh.prefix, collection, signature)
+	maxZoom := gs.info.MaxZoom(geoTileSize)
+	switch paramstr {
+	case "", "tile.json":
+		tj := &TileJSON{
+			TileJSON: "2.2.0",
+			Name:     collection + "/" + signature,
+			Tiles:    []string{url + "/{z}/{x}/{y}.png"},
+			Bounds:   gs.info.Bounds,
+			MinZoom:  0,
+			MaxZoom:  maxZoom,
+		}
+		tj.Center = [3]float64{
+			(gs.info.Bounds[0] + gs.info.Bounds[2]) / 2,
+			(gs.info.Bounds[1] + gs.info.Bounds[3]) / 2,
+			math.Max(0, float64(maxZoom-3)),
+		}
+		resp.Header().Set("Content-type", "application/json")
+		json.NewEncoder(resp).Encode(tj)
+		return
+	case "WMTSCapabilities.xml":
+		type matrix struct {
+			Zoom  int
+			Scale float64
+			Size  int64
+		}
+		data := struct {
+			Title    string
+			URL      string
+			Bounds   [4]float64
+			Matrices []matrix
+		}{
+			Title:  collection + "/" + signature,
+			URL:    url,
+			Bounds: gs.info.Bounds,
+		}
+		for z := 0; z <= maxZoom; z++ {
+			data.Matrices = append(data.Matrices, matrix{
+				Zoom:  z,
+				Scale: 559082264.0287178 / math.Pow(2, float64(z)),
+				Size:  1 << uint(z),
+			})
+		}
+		resp.Header().Set("Content-type", "application/xml")
+		if err := wmtsTemplate.Execute(resp, data); err != nil {
+			mh.log.Errorf("cannot render wmts capabilities: %v", err)
+		}
+		return
+	}
+	matches := xyzTileRegexp.FindStringSubmatch(paramstr)
+	if matches == nil {
+		mh.DoPanicf(resp, http.StatusNotFound, "invalid tile path %s", false, paramstr)
+		return
+	}
+	z, _ := strconv.Atoi(matches[1])
+	x, _ := strconv.Atoi(matches[2])
+	y, _ := strconv.Atoi(matches[3])
+	mh.serveGeoTile(resp, req, gs, z, x, y, matches[4])
+}
@@ -1,7 +1,11 @@
 package mediaserver
 
 import (
+	"fmt"
 	"github.com/goph/emperror"
+	ffmpeg_models "github.com/je4/goffmpeg/models"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"github.com/je4/zmedia/v2/pkg/media"
 	"io"
 	"mime"
 	"net/http"
@@ -36,15 +40,35 @@ func MimeRelevance(mimetype string) (relevance int) {
 	return 100
 }
 
+/*
+text of masters is indexed for full text search. it is truncated well below the 1 MB limit of
+tsvector and keeps the master rows small
+*/
+const maxIndexText = 256 << 10
+
+// indexText truncates the text for the full text index
+func indexText(data []byte) string {
+	if len(data) > maxIndexText {
+		data = data[:maxIndexText]
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
 type Indexer struct {
-	ffProbe      *FFProbe
-	Siegfried    *Siegfried
-	identify     *ImagickIdentify
-	identTimeout time.Duration
-	mh           *MediaHandler
+	ffProbe         *FFProbe
+	Siegfried       *Siegfried
+	identify        *ImagickIdentify
+	loudness        *FFLoudness
+	exifTool        *ExifTool
+	dcraw           *DCRaw
+	gdal            *GDALInfo
+	pdf             *PDFInfo
+	identTimeout    time.Duration
+	loudnessTimeout time.Duration
+	mh              *MediaHandler
 }
 
-func NewIndexer(mh *MediaHandler, siegfriedurl, ffprobe, identify, convert string, identTimeout time.Duration) (*Indexer, error) {
+func NewIndexer(mh *MediaHandler, siegfriedurl, ffprobe, identify, convert, exiftool, ffmpeg, dcraw, gdalinfo, pdfinfo, pdftotext string, identTimeout, loudnessTimeout, textTimeout time.Duration) (*Indexer, error) {
 	ffp, err := NewFFProbe(mh, ffprobe)
 	if err != nil {
 		return nil, emperror.Wrapf(err, "cannot instantiate ffprobe %s", ffprobe)
@@ -58,11 +82,42 @@ func NewIndexer(mh *MediaHandler, siegfriedurl, ffprobe, identify, convert strin
 		return nil, emperror.Wrapf(err, "cannot instantiate identify %s", identify)
 	}
 	idx := &Indexer{
-		mh:           mh,
-		ffProbe:      ffp,
-		Siegfried:    sf,
-		identify:     i,
-		identTimeout: identTimeout,
+		mh:              mh,
+		ffProbe:         ffp,
+		Siegfried:       sf,
+		identify:        i,
+		identTimeout:    identTimeout,
+		loudnessTimeout: loudnessTimeout,
+	}
+	// embedded metadata extraction is optional
+	if exiftool != "" {
+		if idx.exifTool, err = NewExifTool(mh, exiftool); err != nil {
+			return nil, emperror.Wrapf(err, "cannot instantiate exiftool %s", exiftool)
+		}
+	}
+	// raw support is optional
+	if dcraw != "" {
+		if idx.dcraw, err = NewDCRaw(mh, dcraw); err != nil {
+			return nil, emperror.Wrapf(err, "cannot instantiate dcraw %s", dcraw)
+		}
+	}
+	// georeference of maps is optional
+	if gdalinfo != "" {
+		if idx.gdal, err = NewGDALInfo(mh, gdalinfo); err != nil {
+			return nil, emperror.Wrapf(err, "cannot instantiate gdalinfo %s", gdalinfo)
+		}
+	}
+	// without pdfinfo, pdf masters are ingested without metadata
+	if pdfinfo != "" {
+		if idx.pdf, err = NewPDFInfo(mh, pdfinfo, pdftotext, textTimeout); err != nil {
+			return nil, emperror.Wrapf(err, "cannot instantiate pdfinfo %s", pdfinfo)
+		}
+	}
+	// loudness analysis is optional
+	if ffmpeg != "" {
+		if idx.loudness, err = NewFFLoudness(mh, ffmpeg); err != nil {
+			return nil, emperror.Wrapf(err, "cannot instantiate loudness analysis %s", ffmpeg)
+		}
 	}
 	return idx, nil
 }
@@ -74,32 +129,185 @@ func (idx *Indexer) SetMediaHandler(mh *MediaHandler) {
 	idx.identify.SetMediaHandler(mh)
 	idx.Siegfried.SetMediaHandler(mh)
 	idx.ffProbe.SetMediaHandler(mh)
+	if idx.loudness != nil {
+		idx.loudness.SetMediaHandler(mh)
+	}
+	if idx.exifTool != nil {
+		idx.exifTool.SetMediaHandler(mh)
+	}
+	if idx.dcraw != nil {
+		idx.dcraw.SetMediaHandler(mh)
+	}
+	if idx.gdal != nil {
+		idx.gdal.SetMediaHandler(mh)
+	}
+	if idx.pdf != nil {
+		idx.pdf.SetMediaHandler(mh)
+	}
 }
 
 func (idx *Indexer) GetImageMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
 	var result = make(map[string]interface{})
 	width, height, duration, mimetype, sub, result["identify"], err = idx.identify.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		return
+	}
+	idx.getEmbedded(filename, result)
+	metadata = result
+	return
+}
+
+/*
+GetSVGMetadata takes the size of svg masters from the sanitized document. identify and exiftool would
+parse the raw svg, which could reference external resources
+*/
+func (idx *Indexer) GetSVGMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
+	reader, _, err := idx.mh.FileOpenRead(filename, filesystem.FileGetOptions{})
+	if err != nil {
+		err = emperror.Wrapf(err, "cannot open %s", filename)
+		return
+	}
+	defer reader.Close()
+	if width, height, err = media.SVGSize(reader); err != nil {
+		err = emperror.Wrapf(err, "cannot get size of %s", filename)
+		return
+	}
+	mimetype, sub = "image/svg+xml", "svg"
+	metadata = map[string]interface{}{"svg": map[string]int64{"width": width, "height": height}}
+	return
+}
+
+// imagemagick cannot identify raw images reliably, dimensions are taken from dcraw
+func (idx *Indexer) GetRawMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
+	var result = make(map[string]interface{})
+	if idx.dcraw == nil {
+		err = fmt.Errorf("no dcraw for raw image %s", filename)
+		return
+	}
+	info, err := idx.dcraw.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		return
+	}
+	width, height, sub = info.Width, info.Height, "raw"
+	result["dcraw"] = info
+	idx.getEmbedded(filename, result)
 	metadata = result
 	return
 }
 
+// dimensions of a pdf are the size of its first page in points
+func (idx *Indexer) GetPDFMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
+	metadata = make(map[string]interface{})
+	mimetype, sub = "application/pdf", "pdf"
+	if idx.pdf == nil {
+		return
+	}
+	info, err := idx.pdf.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		err = emperror.Wrapf(err, "cannot get pdf metadata of %s", filename)
+		return
+	}
+	width, height = info.firstPage()
+	metadata["pdf"] = info
+	return
+}
+
 func (idx *Indexer) GetVideoMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
+	var result = make(map[string]interface{})
+	var ffmeta interface{}
+	width, height, duration, mimetype, sub, ffmeta, err = idx.ffProbe.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		return
+	}
+	result["ffprobe"] = ffmeta
+	if meta, ok := ffmeta.(ffmpeg_models.Metadata); ok && hasAudioStream(meta) {
+		idx.getLoudness(filename, result)
+	}
+	metadata = result
+	return
+}
+
+func (idx *Indexer) GetAudioMetadata(filename string) (width, height, duration int64, mimetype, sub string, metadata map[string]interface{}, err error) {
 	var result = make(map[string]interface{})
 	width, height, duration, mimetype, sub, result["ffprobe"], err = idx.ffProbe.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		return
+	}
+	idx.getLoudness(filename, result)
 	metadata = result
 	return
 }
 
+// adds embedded exif/iptc/xmp metadata. errors do not stop the ingest
+func (idx *Indexer) getEmbedded(filename string, metadata map[string]interface{}) {
+	if idx.exifTool == nil {
+		return
+	}
+	embedded, err := idx.exifTool.GetMetadata(filename, idx.identTimeout)
+	if err != nil {
+		idx.mh.log.Warningf("cannot get embedded metadata of %s: %v", filename, err)
+		return
+	}
+	metadata["embedded"] = embedded
+}
+
+func hasAudioStream(meta ffmpeg_models.Metadata) bool {
+	for _, stream := range meta.Streams {
+		if stream.CodecType == "audio" {
+			return true
+		}
+	}
+	return false
+}
+
+// adds EBU R128 loudness to metadata. the analysis is optional, errors do not stop the ingest
+func (idx *Indexer) getLoudness(filename string, metadata map[string]interface{}) {
+	if idx.loudness == nil {
+		return
+	}
+	loudness, err := idx.loudness.GetMetadata(filename, idx.loudnessTimeout)
+	if err != nil {
+		idx.mh.log.Warningf("cannot get loudness of %s: %v", filename, err)
+		return
+	}
+	metadata["loudness"] = loudness
+}
+
 func (idx *Indexer) GetMetadata(filename string, _type, subtype, mimetype string) (width, height, duration int64, _mimetype, sub string, metadata map[string]interface{}, err error) {
 	var m string
 
 	switch _type {
 	case "image":
-		width, height, duration, m, sub, metadata, err = idx.GetImageMetadata(filename)
+		if media.IsRawMimetype(mimetype) {
+			width, height, duration, m, sub, metadata, err = idx.GetRawMetadata(filename)
+		} else if mimetype == "image/svg+xml" {
+			width, height, duration, m, sub, metadata, err = idx.GetSVGMetadata(filename)
+		} else {
+			width, height, duration, m, sub, metadata, err = idx.GetImageMetadata(filename)
+		}
+		if err == nil && idx.gdal != nil && isGeoCandidate(mimetype) {
+			// a broken georeference does not prevent the ingest of the image
+			if geo, err2 := idx.gdal.GetMetadata(filename, idx.identTimeout); err2 != nil {
+				idx.mh.log.Warningf("cannot get georeference of %s: %v", filename, err2)
+			} else if geo != nil {
+				// maps are served as xyz tiles
+				metadata["geo"] = geo
+			}
+		}
 	case "video":
 		width, height, duration, m, sub, metadata, err = idx.GetVideoMetadata(filename)
+	case "audio":
+		width, height, duration, m, sub, metadata, err = idx.GetAudioMetadata(filename)
+	case "archive":
+		// members are indexed as child masters
+		metadata = make(map[string]interface{})
+	case "pdf":
+		width, height, duration, m, sub, metadata, err = idx.GetPDFMetadata(filename)
+	case "office":
+		// previews are rendered from the pdf conversion
+		metadata = make(map[string]interface{})
 	default:
-		err = emperror.Wrapf(err, "invalid type %s", _type)
+		err = fmt.Errorf("invalid type %s", _type)
 		return
 	}
 	if MimeRelevance(m) > MimeRelevance(mimetype) {
@@ -158,7 +366,10 @@ func (idx *Indexer) GetType(filename string) (_type, subtype, mimetype string, m
 	}
 	_type, subtype = mime1, strings.ToLower(mime2)
 	if mime1 == "application" && mime2 == "pdf" {
-		_type, subtype = "text", "pdf"
+		_type, subtype = "pdf", "pdf"
+	}
+	if media.IsOfficeMimetype(mimetype) {
+		_type = "office"
 	}
 	return
 }
@@ -0,0 +1,271 @@
+package mediaserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/gorilla/mux"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SetAdminToken enables the administrative api for requests with "Authorization: Bearer <token>"
+func (mh *MediaHandler) SetAdminToken(token string) {
+	mh.adminToken = token
+}
+
+func (mh *MediaHandler) checkAdmin(resp http.ResponseWriter, req *http.Request) bool {
+	if mh.adminToken == "" {
+		mh.DoPanicf(resp, http.StatusForbidden, "administration disabled", true)
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(mh.adminToken)) != 1 {
+		mh.DoPanicf(resp, http.StatusUnauthorized, "invalid token", true)
+		return false
+	}
+	return true
+}
+
+func (mh *MediaHandler) fileSHA256(path string) (string, error) {
+	reader, _, err := mh.FileOpenRead(path, filesystem.FileGetOptions{})
+	if err != nil {
+		return "", emperror.Wrapf(err, "cannot open %s", path)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", emperror.Wrapf(err, "cannot read %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+MasterChanged compares the file of the master with the ingested version. size and modification time
+are checked, with checksum a newer file is only changed, if its sha256 differs
+*/
+func (mh *MediaHandler) MasterChanged(master *database.Master, checksum bool) (bool, error) {
+	mastercache, err := mh.mdb.GetCacheByMaster(master, "master", "")
+	if err != nil {
+		// never ingested
+		return false, nil
+	}
+	fs, bucket, path, err := mh.GetFS(master.Urn)
+	if err != nil {
+		return false, emperror.Wrapf(err, "cannot get filesystem for %s", master.Urn)
+	}
+	finfo, err := fs.FileStat(bucket, path, filesystem.FileStatOptions{})
+	if err != nil {
+		return false, emperror.Wrapf(err, "cannot stat master %s", master.Urn)
+	}
+	if finfo.Size() != mastercache.Filesize {
+		return true, nil
+	}
+	if !finfo.ModTime().After(mastercache.CacheTime) {
+		return false, nil
+	}
+	if !checksum || master.Sha256 == "" {
+		return true, nil
+	}
+	sum, err := mh.fileSHA256(master.Urn)
+	if err != nil {
+		return false, emperror.Wrapf(err, "cannot get checksum of %s", master.Urn)
+	}
+	return !strings.EqualFold(sum, master.Sha256), nil
+}
+
+/*
+dropMaster deletes the ingested master, all derivatives and tiles. the ingested master is removed first,
+so that derivatives, which are created at the same time, are discarded
+*/
+func (mh *MediaHandler) dropMaster(coll *database.Collection, master *database.Master) (int64, error) {
+	var num int64
+	if mastercache, err := mh.mdb.GetCacheByMaster(master, "master", ""); err == nil {
+		if err := mh.removeCache(mastercache); err != nil {
+			return num, err
+		}
+		num++
+	}
+	if err := mh.mdb.GetCachesByMaster(master, func(cache *database.Cache) error {
+		if err := mh.removeCache(cache); err != nil {
+			return err
+		}
+		num++
+		return nil
+	}); err != nil {
+		return num, emperror.Wrapf(err, "cannot delete derivatives of %s/%s", coll.Name, master.Signature)
+	}
+	stor, err := coll.GetStorage()
+	if err != nil {
+		return num, emperror.Wrapf(err, "cannot get storage #%v from collection %s", coll.StorageId, coll.Name)
+	}
+	if err := mh.FileDeleteAll(tileFolder(stor, coll, master)); err != nil {
+		return num, emperror.Wrapf(err, "cannot delete tiles of %s/%s", coll.Name, master.Signature)
+	}
+	// the changed master gets a new chance
+	if err := mh.mdb.DeleteFailures(master); err != nil {
+		return num, emperror.Wrapf(err, "cannot delete failures of %s/%s", coll.Name, master.Signature)
+	}
+	return num, nil
+}
+
+/*
+InvalidateMaster deletes the ingested master, all derivatives and tiles and ingests the master again.
+members of a container are ingested again with it. derivatives are recreated on request
+*/
+func (mh *MediaHandler) InvalidateMaster(collection, signature string) error {
+	return mh.invalidateMaster(collection, signature, false)
+}
+
+/*
+invalidateChanged invalidates a changed master only once. concurrent requests wait for the running
+invalidation and nothing is done, if the master has been ingested again in the meantime
+*/
+func (mh *MediaHandler) invalidateChanged(collection, signature string) error {
+	_, err := mh.coalesce.Do("invalidate/"+cacheKey(collection, signature, "master", ""), func() (*database.Cache, error) {
+		return nil, mh.invalidateMaster(collection, signature, true)
+	})
+	return err
+}
+
+func (mh *MediaHandler) invalidateMaster(collection, signature string, onlyChanged bool) error {
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	master, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	// requests for the master wait until it is ingested again
+	if mh.locking {
+		unlock, err := mh.lock(collection, signature, "master", "")
+		if err != nil {
+			return emperror.Wrapf(err, "cannot lock %s/%s", collection, signature)
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				mh.log.Errorf("cannot unlock %s/%s: %v", collection, signature, err)
+			}
+		}()
+	}
+	if onlyChanged {
+		changed, err := mh.MasterChanged(master, false)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot check master %s/%s", collection, signature)
+		}
+		if !changed {
+			return nil
+		}
+	}
+	num, err := mh.dropMaster(coll, master)
+	if err != nil {
+		return err
+	}
+	mh.log.Infof("%s/%s: %v cache entries removed", collection, signature, num)
+	if err := mh.mdb.GetChildSignatures(master, func(childSignature string) error {
+		child, err := mh.mdb.GetMaster(coll, childSignature)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot load master %s/%s", collection, childSignature)
+		}
+		num, err := mh.dropMaster(coll, child)
+		if err != nil {
+			return err
+		}
+		mh.log.Infof("%s/%s: %v cache entries removed", collection, childSignature, num)
+		return nil
+	}); err != nil {
+		return emperror.Wrapf(err, "cannot invalidate members of %s/%s", collection, signature)
+	}
+	if _, err := mh.createCache(collection, signature, "master", "", map[string]string{}); err != nil {
+		return emperror.Wrapf(err, "cannot ingest master %s/%s", collection, signature)
+	}
+	return nil
+}
+
+/*
+CheckCollection invalidates all changed masters of collection. with force, all masters
+are invalidated
+*/
+func (mh *MediaHandler) CheckCollection(collection string, checksum, force bool) (int64, error) {
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return 0, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	var signatures []string
+	if err := mh.mdb.GetMasterSignatures(coll, func(signature string) error {
+		signatures = append(signatures, signature)
+		return nil
+	}); err != nil {
+		return 0, emperror.Wrapf(err, "cannot list masters of %s", collection)
+	}
+	var num int64
+	for _, signature := range signatures {
+		master, err := mh.mdb.GetMaster(coll, signature)
+		if err != nil {
+			mh.log.Errorf("cannot load master %s/%s: %v", collection, signature, err)
+			continue
+		}
+		changed := force
+		if !changed {
+			if changed, err = mh.MasterChanged(master, checksum); err != nil {
+				mh.log.Errorf("cannot check master %s/%s: %v", collection, signature, err)
+				continue
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := mh.InvalidateMaster(collection, signature); err != nil {
+			mh.log.Errorf("cannot invalidate master %s/%s: %v", collection, signature, err)
+			continue
+		}
+		num++
+	}
+	return num, nil
+}
+
+/*
+ServeInvalidate is the api for invalidation.
+
+	POST invalidate/{collection}/{signature}   invalidates the master
+	POST invalidate/{collection}[?force=true]  invalidates changed (or all) masters in the background
+*/
+func (mh *MediaHandler) ServeInvalidate(resp http.ResponseWriter, req *http.Request) {
+	if !mh.checkAdmin(resp, req) {
+		return
+	}
+	vars := mux.Vars(req)
+	collection := vars["collection"]
+	signature, ok := vars["signature"]
+	resp.Header().Set("Content-type", "application/json")
+	if ok {
+		if err := mh.InvalidateMaster(collection, signature); err != nil {
+			mh.DoPanicf(resp, http.StatusInternalServerError, "cannot invalidate %s/%s: %v", true, collection, signature, err)
+			return
+		}
+		json.NewEncoder(resp).Encode(map[string]string{"collection": collection, "signature": signature, "status": "invalidated"})
+		return
+	}
+	if _, err := mh.mdb.GetCollectionByName(collection); err != nil {
+		mh.DoPanicf(resp, http.StatusNotFound, "invalid collection %s: %v", true, collection, err)
+		return
+	}
+	force := req.URL.Query().Get("force") == "true"
+	go func() {
+		num, err := mh.CheckCollection(collection, true, force)
+		if err != nil {
+			mh.log.Errorf("cannot check collection %s: %v", collection, err)
+			return
+		}
+		mh.log.Infof("collection %s: %v masters invalidated", collection, num)
+	}()
+	resp.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(resp).Encode(map[string]string{"collection": collection, "status": fmt.Sprintf("started, force=%v", force)})
+}
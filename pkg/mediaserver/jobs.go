@@ -0,0 +1,247 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/gorilla/mux"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/op/go-logging"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+JobQueue creates expensive derivatives outside of the request. jobs are stored in the database,
+so that every instance can work on them
+*/
+type JobQueue struct {
+	mh      *MediaHandler
+	mdb     *database.MediaDatabase
+	log     *logging.Logger
+	actions map[string]bool
+	workers int
+	poll    time.Duration
+	timeout time.Duration
+	wake    chan bool
+	end     chan bool
+	wg      sync.WaitGroup
+}
+
+/*
+NewJobQueue creates a queue for actions with workers parallel jobs. waiting jobs are checked every poll interval,
+jobs running longer than timeout are started again
+*/
+func NewJobQueue(mh *MediaHandler, mdb *database.MediaDatabase, actions []string, workers int, poll, timeout time.Duration, log *logging.Logger) (*JobQueue, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid number of workers %v", workers)
+	}
+	jq := &JobQueue{
+		mh:      mh,
+		mdb:     mdb,
+		log:     log,
+		actions: make(map[string]bool),
+		workers: workers,
+		poll:    poll,
+		timeout: timeout,
+		wake:    make(chan bool, 1),
+		end:     make(chan bool),
+	}
+	for _, action := range actions {
+		jq.actions[strings.ToLower(action)] = true
+	}
+	return jq, nil
+}
+
+// IsAsync checks, whether derivatives of action are created by jobs
+func (jq *JobQueue) IsAsync(action string) bool {
+	return jq.actions[strings.ToLower(action)]
+}
+
+// Enqueue adds a job for the derivative. paramstr has to be normalized
+func (jq *JobQueue) Enqueue(collection, signature, action, paramstr string) (*database.Job, error) {
+	coll, err := jq.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	job, err := jq.mdb.CreateJob(coll, signature, action, paramstr)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create job for %s/%s/%s/%s", collection, signature, action, paramstr)
+	}
+	// wake up a waiting worker of this instance
+	select {
+	case jq.wake <- true:
+	default:
+	}
+	return job, nil
+}
+
+func (jq *JobQueue) run(job *database.Job) {
+	coll, err := job.GetCollection()
+	if err != nil {
+		job.Status = database.JobError
+		job.Error = fmt.Sprintf("cannot get collection #%v: %v", job.CollectionId, err)
+	} else {
+		jq.log.Infof("job #%v: %s/%s/%s/%s", job.Id, coll.Name, job.Signature, job.Action, job.Params)
+		cache, err := jq.mh.GetCache(coll.Name, job.Signature, job.Action, job.Params)
+		if err != nil {
+			job.Status = database.JobError
+			job.Error = err.Error()
+		} else {
+			job.Status = database.JobDone
+			job.CacheId = cache.Id
+		}
+	}
+	if job.Status == database.JobError {
+		jq.log.Errorf("job #%v failed: %s", job.Id, job.Error)
+	}
+	if err := job.Store(); err != nil {
+		jq.log.Errorf("cannot store job #%v: %v", job.Id, err)
+	}
+}
+
+func (jq *JobQueue) worker() {
+	defer jq.wg.Done()
+	for {
+		job, err := jq.mdb.NextJob()
+		if err == nil {
+			jq.run(job)
+			continue
+		}
+		if err != database.ErrNotFound {
+			jq.log.Errorf("cannot get next job: %v", err)
+		}
+		select {
+		case <-jq.wake:
+		case <-time.After(jq.poll):
+		case <-jq.end:
+			return
+		}
+	}
+}
+
+// reset queues the jobs again, which were started before timeout. their instance was stopped or hangs
+func (jq *JobQueue) reset() {
+	if num, err := jq.mdb.ResetJobs(jq.timeout); err != nil {
+		jq.log.Errorf("cannot reset jobs: %v", err)
+	} else if num > 0 {
+		jq.log.Infof("%v aborted jobs queued again", num)
+		select {
+		case jq.wake <- true:
+		default:
+		}
+	}
+}
+
+// resetter looks for aborted jobs of all instances every poll interval
+func (jq *JobQueue) resetter() {
+	defer jq.wg.Done()
+	for {
+		jq.reset()
+		select {
+		case <-time.After(jq.poll):
+		case <-jq.end:
+			return
+		}
+	}
+}
+
+// Start runs the workers until Stop is called
+func (jq *JobQueue) Start() {
+	jq.wg.Add(1)
+	go jq.resetter()
+	for i := 0; i < jq.workers; i++ {
+		jq.wg.Add(1)
+		go jq.worker()
+	}
+}
+
+// Stop waits for the running jobs
+func (jq *JobQueue) Stop() {
+	close(jq.end)
+	jq.wg.Wait()
+}
+
+// SetJobQueue enables the asynchronous creation of derivatives
+func (mh *MediaHandler) SetJobQueue(jobs *JobQueue) {
+	mh.jobs = jobs
+}
+
+type jobStatus struct {
+	*database.Job
+	StatusURL string `json:"statusurl"`
+	URL       string `json:"url,omitempty"`
+}
+
+func (mh *MediaHandler) writeJob(resp http.ResponseWriter, status int, job *database.Job, collection string) {
+	js := jobStatus{
+		Job:       job,
+		StatusURL: fmt.Sprintf("/%s/job/%v", mh.prefix, job.Id),
+	}
+	if job.Status == database.JobDone {
+		js.URL = strings.TrimRight(fmt.Sprintf("/%s/%s/%s/%s/%s", mh.prefix, collection, job.Signature, job.Action, job.Params), "/")
+	}
+	resp.Header().Set("Content-type", "application/json")
+	if status == http.StatusAccepted {
+		resp.Header().Set("Location", js.StatusURL)
+	}
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(js)
+}
+
+/*
+serveAsync queues a job for missing derivatives of asynchronous actions and answers with 202.
+returns false, if the derivative exists
+*/
+func (mh *MediaHandler) serveAsync(resp http.ResponseWriter, req *http.Request, collection, signature, action, paramstr string) bool {
+	_, paramstr, err := mh.normalize(action, paramstr)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusBadRequest, "invalid parameters %s: %v", false, paramstr, err)
+		return true
+	}
+	_, err = mh.mdb.GetCache(collection, signature, action, paramstr)
+	if err != database.ErrNotFound {
+		return false
+	}
+	if failure, active := mh.activeFailure(collection, signature, action, paramstr); active {
+		mh.serveFailure(resp, req, failure)
+		return true
+	}
+	job, err := mh.jobs.Enqueue(collection, signature, action, paramstr)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot queue %s/%s/%s/%s: %v", false, collection, signature, action, paramstr, err)
+		return true
+	}
+	mh.writeJob(resp, http.StatusAccepted, job, collection)
+	return true
+}
+
+/*
+ServeJob reports the state of a job and the url of the derivative. progress is the position in the queue
+of waiting jobs and the start time of running jobs, the actions do not report a percentage
+*/
+func (mh *MediaHandler) ServeJob(resp http.ResponseWriter, req *http.Request) {
+	jobid, err := strconv.ParseInt(mux.Vars(req)["jobid"], 10, 64)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusBadRequest, "invalid job id: %v", true, err)
+		return
+	}
+	job, err := mh.mdb.GetJob(jobid)
+	if err == database.ErrNotFound {
+		mh.DoPanicf(resp, http.StatusNotFound, "job #%v not found", true, jobid)
+		return
+	}
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot load job #%v: %v", true, jobid, err)
+		return
+	}
+	coll, err := job.GetCollection()
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot load collection of job #%v: %v", true, jobid, err)
+		return
+	}
+	mh.writeJob(resp, http.StatusOK, job, coll.Name)
+}
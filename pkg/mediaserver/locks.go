@@ -0,0 +1,74 @@
+package mediaserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of mutexes shared by all tiles
+const tileLockStripes = 256
+
+/*
+SetLocking enables database locks around ingest and creation of derivatives and tiles.
+needed, if several instances share the database and the storages. waiting for a lock fails after timeout
+*/
+func (mh *MediaHandler) SetLocking(locking bool, timeout time.Duration) {
+	mh.locking = locking
+	mh.lockWait = timeout
+}
+
+// cacheKey identifies requests for the same cache entry, which wait for each other
+func cacheKey(collection, signature, action, paramstr string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", strings.ToLower(collection), signature, action, paramstr)
+}
+
+// withLock runs fn with the database lock of the cache entry, if locking is enabled
+func (mh *MediaHandler) withLock(collection, signature, action, paramstr string, fn func() (*database.Cache, error)) (*database.Cache, error) {
+	if !mh.locking {
+		return fn()
+	}
+	key := cacheKey(collection, signature, action, paramstr)
+	unlock, err := mh.lock(collection, signature, action, paramstr)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot lock %s", key)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			mh.log.Errorf("cannot unlock %s: %v", key, err)
+		}
+	}()
+	return fn()
+}
+
+// lock uses the hash of the cache filename as lock key
+func (mh *MediaHandler) lock(collection, signature, action, paramstr string) (func() error, error) {
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	hash := buildHash(coll.Name, signature, action, paramstr)
+	return mh.mdb.Lock(int64(binary.BigEndian.Uint64(hash[:8])), mh.lockWait)
+}
+
+// lockTile uses the hash of the path of a tile or level as lock key, so that instances do not write the same tiles
+func (mh *MediaHandler) lockTile(path string) (func() error, error) {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return mh.mdb.Lock(int64(h.Sum64()), mh.lockWait)
+}
+
+/*
+tileLock returns the mutex of a tile or level. there are too many tiles to keep a mutex for each of them,
+so they share a fixed set of mutexes, which are never removed
+*/
+func (mh *MediaHandler) tileLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &mh.tileLocks[h.Sum32()%tileLockStripes]
+}
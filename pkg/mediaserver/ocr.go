@@ -0,0 +1,63 @@
+package mediaserver
+
+import (
+	"bytes"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+SetOCR enables the ocr action for images and pdf documents. with ingest, the text of new masters
+is recognized in the background after ingest
+*/
+func (mh *MediaHandler) SetOCR(ocr *media.OCR, ingest bool) {
+	mh.ocr = ocr
+	mh.ocrIngest = ingest
+}
+
+// the complete text is the plain text result without page
+func isOCRText(action string, params map[string]string) bool {
+	if action != "ocr" || params["page"] != "" {
+		return false
+	}
+	format, ok := params["format"]
+	return !ok || format == "txt"
+}
+
+// storeOCRText copies the recognized text of a master into its metadata
+func (mh *MediaHandler) storeOCRText(coll *database.Collection, signature string, cache *database.Cache) error {
+	reader, _, err := mh.FileOpenRead(cache.Path, filesystem.FileGetOptions{})
+	if err != nil {
+		return emperror.Wrapf(err, "cannot open %s", cache.Path)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return emperror.Wrapf(err, "cannot read %s", cache.Path)
+	}
+	text := indexText(data)
+
+	// reload, the master could have been changed since the action started
+	master, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot load master %s/%s", coll.Name, signature)
+	}
+	metadata, ok := master.Metadata.(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+	}
+	metadata["ocr"] = map[string]interface{}{
+		// tesseract ends every page with a form feed, the text could be truncated
+		"pages": bytes.Count(data, []byte("\f")),
+		"text":  strings.TrimSpace(strings.ReplaceAll(text, "\f", "\n")),
+	}
+	master.Metadata = metadata
+	if err := master.Store(); err != nil {
+		return emperror.Wrapf(err, "cannot store master %s/%s", coll.Name, signature)
+	}
+	return nil
+}
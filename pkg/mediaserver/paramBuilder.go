@@ -2,6 +2,10 @@ package mediaserver
 
 import (
 	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -22,5 +26,80 @@ func (pb ParamBuilder) Clear(action string, params []string) (map[string]string,
 			}
 		}
 	}
+	if err := normalizeClip(result); err != nil {
+		return nil, emperror.Wrapf(err, "invalid clip parameters for action %s", action)
+	}
 	return result, nil
 }
+
+/*
+Pipeline keeps the order of the path segments. Every operation has to be allowed for the action.
+the result is the canonical form, which is used as parameter string
+*/
+func (pb ParamBuilder) Pipeline(action string, params []string) (string, error) {
+	ps, ok := pb[action]
+	if !ok {
+		return "", fmt.Errorf("action %s not allowed", action)
+	}
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		name := media.PipelineOpName(param)
+		var allowed bool
+		for _, key := range ps {
+			if key == name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("operation %s not allowed for action %s", param, action)
+		}
+	}
+	p, err := media.ParsePipeline(params)
+	if err != nil {
+		return "", emperror.Wrapf(err, "invalid pipeline for action %s", action)
+	}
+	return p.String(), nil
+}
+
+/*
+bring start, end and duration into canonical form (seconds), so that the same excerpt
+results in the same parameter string. duration is converted to end
+*/
+func normalizeClip(params map[string]string) error {
+	var start, end float64
+	var err error
+	if val, ok := params["start"]; ok {
+		if start, err = media.ParseTimecode(val); err != nil {
+			return emperror.Wrapf(err, "invalid start %s", val)
+		}
+		if start == 0 {
+			delete(params, "start")
+		} else {
+			params["start"] = strconv.FormatFloat(start, 'f', -1, 64)
+		}
+	}
+	if val, ok := params["duration"]; ok {
+		duration, err := media.ParseTimecode(val)
+		if err != nil {
+			return emperror.Wrapf(err, "invalid duration %s", val)
+		}
+		if _, ok := params["end"]; ok {
+			return fmt.Errorf("end and duration cannot be combined")
+		}
+		delete(params, "duration")
+		params["end"] = strconv.FormatFloat(math.Round((start+duration)*1000)/1000, 'f', -1, 64)
+	}
+	if val, ok := params["end"]; ok {
+		if end, err = media.ParseTimecode(val); err != nil {
+			return emperror.Wrapf(err, "invalid end %s", val)
+		}
+		if end <= start {
+			return fmt.Errorf("end %v not after start %v", end, start)
+		}
+		params["end"] = strconv.FormatFloat(end, 'f', -1, 64)
+	}
+	return nil
+}
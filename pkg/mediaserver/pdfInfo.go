@@ -0,0 +1,196 @@
+package mediaserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/goph/emperror"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sizes of more pages are not listed
+const pdfMaxPageSizes = 1000
+
+// PDFMetadata is the result of pdfinfo and pdftotext. page sizes are in points (1/72 inch) and rotated
+type PDFMetadata struct {
+	Pages     int64         `json:"pages"`
+	PageSizes []PDFPageSize `json:"pagesizes,omitempty"`
+	Version   string        `json:"version,omitempty"`
+	Title     string        `json:"title,omitempty"`
+	Author    string        `json:"author,omitempty"`
+	Subject   string        `json:"subject,omitempty"`
+	Keywords  string        `json:"keywords,omitempty"`
+	Creator   string        `json:"creator,omitempty"`
+	Producer  string        `json:"producer,omitempty"`
+	Created   string        `json:"created,omitempty"`
+	Modified  string        `json:"modified,omitempty"`
+	Tagged    bool          `json:"tagged,omitempty"`
+	Encrypted bool          `json:"encrypted,omitempty"`
+	PDFA      string        `json:"pdfa,omitempty"`
+	Text      string        `json:"text,omitempty"`
+}
+
+type PDFPageSize struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+var pdfPageSizeRegexp = regexp.MustCompile(`^Page\s+([0-9]+)\s+size:\s+([0-9.]+)\s+x\s+([0-9.]+)`)
+var pdfPageRotRegexp = regexp.MustCompile(`^Page\s+([0-9]+)\s+rot:\s+([0-9]+)`)
+
+// pdf/a identification of the xmp metadata as attribute or element
+var pdfaPartRegexp = regexp.MustCompile(`pdfaid:part(?:="|>)\s*([0-9]+)`)
+var pdfaConformanceRegexp = regexp.MustCompile(`pdfaid:conformance(?:="|>)\s*([A-Za-z])`)
+
+type PDFInfo struct {
+	pdfinfo     string
+	pdftotext   string
+	textTimeout time.Duration
+	mh          *MediaHandler
+}
+
+func NewPDFInfo(mh *MediaHandler, pdfinfo, pdftotext string, textTimeout time.Duration) (*PDFInfo, error) {
+	pi := &PDFInfo{
+		pdfinfo: pdfinfo, pdftotext: pdftotext, textTimeout: textTimeout, mh: mh,
+	}
+	return pi, nil
+}
+
+func (pi *PDFInfo) SetMediaHandler(mh *MediaHandler) {
+	pi.mh = mh
+}
+
+func (pi *PDFInfo) run(command string, cmdparam []string, timeout time.Duration) (*bytes.Buffer, error) {
+	var out, errb bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, cmdparam...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errb
+
+	if err := cmd.Run(); err != nil {
+		return nil, emperror.Wrapf(err, "error executing (%s %s): %v", command, cmdparam, errb.String())
+	}
+	return &out, nil
+}
+
+func parsePDFInfo(out string) (*PDFMetadata, error) {
+	pm := &PDFMetadata{}
+	for _, line := range strings.Split(out, "\n") {
+		if matches := pdfPageSizeRegexp.FindStringSubmatch(line); matches != nil {
+			page, _ := strconv.ParseInt(matches[1], 10, 64)
+			if page != int64(len(pm.PageSizes))+1 {
+				continue
+			}
+			width, _ := strconv.ParseFloat(matches[2], 64)
+			height, _ := strconv.ParseFloat(matches[3], 64)
+			pm.PageSizes = append(pm.PageSizes, PDFPageSize{Width: width, Height: height})
+			continue
+		}
+		if matches := pdfPageRotRegexp.FindStringSubmatch(line); matches != nil {
+			// rotation follows the size of the page
+			page, _ := strconv.ParseInt(matches[1], 10, 64)
+			rot, _ := strconv.ParseInt(matches[2], 10, 64)
+			if page == int64(len(pm.PageSizes)) && rot%180 == 90 {
+				size := &pm.PageSizes[page-1]
+				size.Width, size.Height = size.Height, size.Width
+			}
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "Pages":
+			pm.Pages, _ = strconv.ParseInt(val, 10, 64)
+		case "PDF version":
+			pm.Version = val
+		case "Title":
+			pm.Title = val
+		case "Author":
+			pm.Author = val
+		case "Subject":
+			pm.Subject = val
+		case "Keywords":
+			pm.Keywords = val
+		case "Creator":
+			pm.Creator = val
+		case "Producer":
+			pm.Producer = val
+		case "CreationDate":
+			pm.Created = val
+		case "ModDate":
+			pm.Modified = val
+		case "Tagged":
+			pm.Tagged = val == "yes"
+		case "Encrypted":
+			pm.Encrypted = strings.HasPrefix(val, "yes")
+		}
+	}
+	if pm.Pages == 0 {
+		return nil, fmt.Errorf("no pages in pdfinfo result: %s", out)
+	}
+	return pm, nil
+}
+
+// conformance like 1b or 2u from the xmp metadata
+func parsePDFA(xmp string) string {
+	part := pdfaPartRegexp.FindStringSubmatch(xmp)
+	if part == nil {
+		return ""
+	}
+	result := part[1]
+	if conformance := pdfaConformanceRegexp.FindStringSubmatch(xmp); conformance != nil {
+		result += strings.ToLower(conformance[1])
+	}
+	return result
+}
+
+/*
+GetMetadata reads document information, page sizes and the pdf/a conformance with pdfinfo.
+the embedded text is extracted with pdftotext, if available. documents without text are ingested too
+*/
+func (pi *PDFInfo) GetMetadata(filename string, timeout time.Duration) (*PDFMetadata, error) {
+	// poppler needs a seekable file
+	fname, cleanup, err := pi.mh.localCopy(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	out, err := pi.run(pi.pdfinfo, []string{"-enc", "UTF-8", "-f", "1", "-l", strconv.Itoa(pdfMaxPageSizes), fname}, timeout)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get pdf info of %s", filename)
+	}
+	pm, err := parsePDFInfo(out.String())
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot parse pdf info of %s", filename)
+	}
+	// no xmp metadata is not an error
+	if xmp, err := pi.run(pi.pdfinfo, []string{"-meta", fname}, timeout); err == nil {
+		pm.PDFA = parsePDFA(xmp.String())
+	}
+	if pi.pdftotext != "" {
+		if text, err := pi.run(pi.pdftotext, []string{"-enc", "UTF-8", fname, "-"}, pi.textTimeout); err != nil {
+			pi.mh.log.Warningf("cannot extract text of %s: %v", filename, err)
+		} else {
+			pm.Text = strings.TrimSpace(strings.ReplaceAll(indexText(text.Bytes()), "\f", "\n"))
+		}
+	}
+	return pm, nil
+}
+
+// size of the first page, which is used for the master cache
+func (pm *PDFMetadata) firstPage() (width, height int64) {
+	if len(pm.PageSizes) == 0 {
+		return 0, 0
+	}
+	return int64(math.Round(pm.PageSizes[0].Width)), int64(math.Round(pm.PageSizes[0].Height))
+}
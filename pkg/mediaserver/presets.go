@@ -0,0 +1,57 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"strings"
+)
+
+// SetPresets defines global presets name => action/param1/param2/...
+func (mh *MediaHandler) SetPresets(presets map[string]string) {
+	mh.presets = make(map[string]string)
+	for name, preset := range presets {
+		mh.presets[strings.ToLower(name)] = strings.Trim(preset, "/")
+	}
+}
+
+/*
+resolvePreset returns action and parameters of the preset in paramstr. presets of the collection
+replace global presets with the same name. additional parameters after the name are appended
+*/
+func (mh *MediaHandler) resolvePreset(collection, paramstr string) (string, string, error) {
+	parts := strings.SplitN(strings.Trim(paramstr, "/"), "/", 2)
+	name := strings.ToLower(parts[0])
+	if name == "" {
+		return "", "", fmt.Errorf("no preset name")
+	}
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return "", "", emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	var preset string
+	var ok bool
+	for key, val := range coll.Config.Presets {
+		if strings.ToLower(key) == name {
+			preset, ok = strings.Trim(val, "/"), true
+			break
+		}
+	}
+	if !ok {
+		if preset, ok = mh.presets[name]; !ok {
+			return "", "", fmt.Errorf("unknown preset %s for collection %s", name, collection)
+		}
+	}
+	presetParts := strings.SplitN(preset, "/", 2)
+	action := strings.ToLower(presetParts[0])
+	if action == "" || action == "preset" {
+		return "", "", fmt.Errorf("invalid preset %s: %s", name, preset)
+	}
+	var params []string
+	if len(presetParts) > 1 {
+		params = append(params, presetParts[1])
+	}
+	if len(parts) > 1 {
+		params = append(params, parts[1])
+	}
+	return action, strings.Join(params, "/"), nil
+}
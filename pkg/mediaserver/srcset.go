@@ -0,0 +1,212 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/goph/emperror"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SrcsetPreset defines the width steps and additional resize parameters of a srcset
+type SrcsetPreset struct {
+	Name   string
+	Widths []int64
+	Sizes  string
+	Params []string
+}
+
+type SrcsetCandidate struct {
+	URL    string `json:"url"`
+	Width  int64  `json:"width"`
+	Height int64  `json:"height"`
+}
+
+type Srcset struct {
+	Src        string            `json:"src"`
+	Srcset     string            `json:"srcset"`
+	Sizes      string            `json:"sizes"`
+	Width      int64             `json:"width"`
+	Height     int64             `json:"height"`
+	Candidates []SrcsetCandidate `json:"candidates"`
+	HTML       string            `json:"html"`
+}
+
+// name of the preset, whose widths are used for client hints
+const defaultSrcsetPreset = "default"
+
+var srcsetTemplate = template.Must(template.New("srcset").Parse(
+	`<img src="{{.Src}}" srcset="{{.Srcset}}" sizes="{{.Sizes}}" width="{{.Width}}" height="{{.Height}}" loading="lazy" alt="">`))
+
+func (mh *MediaHandler) SetSrcsetPresets(presets []SrcsetPreset) {
+	mh.srcset = make(map[string]*SrcsetPreset)
+	for i := range presets {
+		preset := presets[i]
+		sort.Slice(preset.Widths, func(i, j int) bool { return preset.Widths[i] < preset.Widths[j] })
+		if preset.Sizes == "" {
+			preset.Sizes = "100vw"
+		}
+		mh.srcset[strings.ToLower(preset.Name)] = &preset
+	}
+}
+
+func (mh *MediaHandler) resizeURL(collection, signature string, width int64, params []string) string {
+	parts := append([]string{fmt.Sprintf("size%dx", width)}, params...)
+	return fmt.Sprintf("/%s/%s/%s/resize/%s", mh.prefix, collection, signature, strings.Join(parts, "/"))
+}
+
+/*
+BuildSrcset lists the derivatives of a preset, which are not larger than the master.
+If the master is smaller than the largest step, its own width completes the list.
+*/
+func (mh *MediaHandler) BuildSrcset(collection, signature, presetname string) (*Srcset, error) {
+	preset, ok := mh.srcset[strings.ToLower(presetname)]
+	if !ok {
+		return nil, fmt.Errorf("unknown srcset preset %s", presetname)
+	}
+	cache, err := mh.GetCache(collection, signature, "master", "")
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get master of %s/%s", collection, signature)
+	}
+	if !strings.HasPrefix(cache.Mimetype, "image/") || cache.Width <= 0 || cache.Height <= 0 {
+		return nil, fmt.Errorf("%s/%s is no image with dimensions", collection, signature)
+	}
+
+	var widths []int64
+	for _, w := range preset.Widths {
+		if w <= cache.Width {
+			widths = append(widths, w)
+		}
+	}
+	if len(widths) == 0 || widths[len(widths)-1] < cache.Width && len(widths) < len(preset.Widths) {
+		widths = append(widths, cache.Width)
+	}
+
+	ss := &Srcset{
+		Sizes: preset.Sizes,
+	}
+	var descriptors []string
+	for _, w := range widths {
+		c := SrcsetCandidate{
+			URL:    mh.resizeURL(collection, signature, w, preset.Params),
+			Width:  w,
+			Height: int64(math.Round(float64(w) * float64(cache.Height) / float64(cache.Width))),
+		}
+		ss.Candidates = append(ss.Candidates, c)
+		descriptors = append(descriptors, fmt.Sprintf("%s %dw", c.URL, c.Width))
+	}
+	ss.Srcset = strings.Join(descriptors, ", ")
+
+	// fallback for browsers without srcset: largest candidate up to 1024 pixels
+	fallback := ss.Candidates[0]
+	for _, c := range ss.Candidates {
+		if c.Width <= 1024 {
+			fallback = c
+		}
+	}
+	ss.Src = fallback.URL
+	last := ss.Candidates[len(ss.Candidates)-1]
+	ss.Width, ss.Height = last.Width, last.Height
+
+	var html strings.Builder
+	if err := srcsetTemplate.Execute(&html, ss); err != nil {
+		return nil, emperror.Wrap(err, "cannot render srcset html")
+	}
+	ss.HTML = html.String()
+	return ss, nil
+}
+
+// srcset as json or with format=html as img element
+func (mh *MediaHandler) ServeSrcset(resp http.ResponseWriter, req *http.Request, collection, signature, preset string) {
+	if preset == "" {
+		preset = defaultSrcsetPreset
+	}
+	ss, err := mh.BuildSrcset(collection, signature, preset)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusBadRequest, "cannot build srcset %s for %s/%s: %v", false, preset, collection, signature, err)
+		return
+	}
+	if req.URL.Query().Get("format") == "html" {
+		resp.Header().Set("Content-type", "text/html; charset=utf-8")
+		resp.Write([]byte(ss.HTML))
+		return
+	}
+	resp.Header().Set("Content-type", "application/json")
+	json.NewEncoder(resp).Encode(ss)
+}
+
+// smallest step, which is not smaller than width
+func snapWidth(width float64, steps []int64) int64 {
+	for _, step := range steps {
+		if float64(step) >= width {
+			return step
+		}
+	}
+	return steps[len(steps)-1]
+}
+
+/*
+applyClientHints replaces the width of a resize request with the nearest step of the default preset.
+Sec-CH-Width is the intended width in physical pixels, Sec-CH-DPR scales the requested width otherwise.
+Requests without width are not changed, the width never exceeds the width of the master.
+*/
+func (mh *MediaHandler) applyClientHints(req *http.Request, collection, signature, action, paramstr string) string {
+	preset, ok := mh.srcset[defaultSrcsetPreset]
+	if action != "resize" || !ok || len(preset.Widths) == 0 {
+		return paramstr
+	}
+	var hintWidth, dpr float64
+	if val := req.Header.Get("Sec-CH-Width"); val != "" {
+		hintWidth, _ = strconv.ParseFloat(val, 64)
+	}
+	if val := req.Header.Get("Sec-CH-DPR"); val != "" {
+		dpr, _ = strconv.ParseFloat(val, 64)
+	}
+
+	params := strings.Split(paramstr, "/")
+	var sizeIdx = -1
+	var width, height int64
+	for i, param := range params {
+		param = strings.ToLower(param)
+		if !strings.HasPrefix(param, "size") {
+			continue
+		}
+		sizes := strings.Split(param[len("size"):], "x")
+		if len(sizes) != 2 {
+			return paramstr
+		}
+		width, _ = strconv.ParseInt(sizes[0], 10, 64)
+		height, _ = strconv.ParseInt(sizes[1], 10, 64)
+		sizeIdx = i
+	}
+
+	var target float64
+	switch {
+	case sizeIdx < 0 || width == 0:
+		return paramstr
+	case hintWidth > 0:
+		target = hintWidth
+	case width > 0 && dpr > 0 && dpr != 1:
+		target = float64(width) * dpr
+	default:
+		return paramstr
+	}
+	newWidth := snapWidth(target, preset.Widths)
+	// no upscaling
+	if mastercache, err := mh.mdb.GetCache(collection, signature, "master", ""); err == nil && mastercache.Width > 0 && newWidth > mastercache.Width {
+		newWidth = mastercache.Width
+	}
+	if newWidth == width {
+		return paramstr
+	}
+	size := fmt.Sprintf("size%dx", newWidth)
+	if height > 0 {
+		size += strconv.FormatInt(int64(math.Round(float64(height)*float64(newWidth)/float64(width))), 10)
+	}
+	params[sizeIdx] = size
+	return strings.Trim(strings.Join(params, "/"), "/")
+}
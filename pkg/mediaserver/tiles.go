@@ -0,0 +1,230 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"github.com/je4/zmedia/v2/pkg/media"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// TileOptions define the deep zoom tiles. zoomify always uses 256 pixel jpeg tiles without overlap
+type TileOptions struct {
+	TileSize int64
+	Overlap  int64
+	Format   string
+}
+
+// defaults of the deep zoom tiles, 254 with one pixel overlap on both sides gives 256 pixel tiles
+const DefaultTileSize = 254
+const DefaultTileOverlap = 1
+const DefaultTileFormat = "jpg"
+
+const zoomifyTileSize = 256
+
+var dziTileRegexp = regexp.MustCompile(`^image_files/([0-9]+)/([0-9]+)_([0-9]+)\.([a-z]+)$`)
+var zoomifyTileRegexp = regexp.MustCompile(`^TileGroup([0-9]+)/([0-9]+)-([0-9]+)-([0-9]+)\.jpg$`)
+
+func (mh *MediaHandler) SetTileOptions(opts TileOptions) {
+	mh.tiles = opts
+}
+
+// tiled image of a master with the location of its tiles in the submaster folder of the storage
+type tileSource struct {
+	coll    *database.Collection
+	master  *database.Master
+	stor    *database.Storage
+	cache   *database.Cache
+	pyramid *media.TilePyramid
+	base    string
+}
+
+/*
+loadTileSource finds the raster image, which is cut into tiles. svg and raw masters cannot be
+read directly, their png rendering at full size is used instead
+*/
+func (mh *MediaHandler) loadTileSource(collection, signature, kind string) (*tileSource, error) {
+	ts := &tileSource{}
+	var err error
+	if ts.coll, err = mh.mdb.GetCollectionByName(collection); err != nil {
+		return nil, emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	if ts.stor, err = ts.coll.GetStorage(); err != nil {
+		return nil, emperror.Wrapf(err, "cannot get storage #%v from collection %s", ts.coll.StorageId, collection)
+	}
+	if ts.cache, err = mh.GetCache(collection, signature, "master", ""); err != nil {
+		return nil, emperror.Wrapf(err, "cannot get master of %s/%s", collection, signature)
+	}
+	if ts.master, err = mh.mdb.GetMaster(ts.coll, signature); err != nil {
+		return nil, emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	if ts.master.Type != "image" {
+		return nil, fmt.Errorf("%s/%s is no image", collection, signature)
+	}
+	if ts.master.Mimetype == "image/svg+xml" || media.IsRawMimetype(ts.master.Mimetype) {
+		if ts.cache, err = mh.GetCache(collection, signature, "resize", "formatpng"); err != nil {
+			return nil, emperror.Wrapf(err, "cannot render %s/%s", collection, signature)
+		}
+	}
+
+	var optstr string
+	switch kind {
+	case "dzi":
+		ts.pyramid, err = media.NewDZIPyramid(ts.cache.Width, ts.cache.Height, mh.tiles.TileSize, mh.tiles.Overlap, mh.tiles.Format)
+		optstr = fmt.Sprintf("%v/%v/%s", mh.tiles.TileSize, mh.tiles.Overlap, mh.tiles.Format)
+	case "zoomify":
+		ts.pyramid, err = media.NewZoomifyPyramid(ts.cache.Width, ts.cache.Height, zoomifyTileSize, "jpg")
+	default:
+		return nil, fmt.Errorf("invalid tile format %s", kind)
+	}
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create %s pyramid of %s/%s", kind, collection, signature)
+	}
+	// tiles of different options or an older version of the master are not mixed up
+	ts.base = tileFolder(ts.stor, ts.coll, ts.master) + "/" + buildFilename(ts.coll, ts.master, kind, optstr+"/"+ts.master.Sha256)
+	return ts, nil
+}
+
+// tileFolder contains all tiles of the master, it is removed with the master
+func tileFolder(stor *database.Storage, coll *database.Collection, master *database.Master) string {
+	return stor.Filebase + "/" + filepath.Join(stor.SubmasterDir, buildFilename(coll, master, "tiles", ""))
+}
+
+func (ts *tileSource) tilePath(level int, col, row int64) string {
+	return fmt.Sprintf("%s/%d/%d_%d.%s", ts.base, level, col, row, ts.pyramid.Format)
+}
+
+/*
+ensureLevel creates all tiles of a level, if they do not exist yet. tiles are written row by row,
+so an interrupted run is detected by the missing last tile
+*/
+func (mh *MediaHandler) ensureLevel(ts *tileSource, level int) error {
+	l := ts.pyramid.Levels[level]
+	last := ts.tilePath(level, l.Cols-1, l.Rows-1)
+
+	key := fmt.Sprintf("%s/%d", ts.base, level)
+	lock := mh.tileLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	exists := func() bool {
+		reader, _, err := mh.FileOpenRead(last, filesystem.FileGetOptions{})
+		if err != nil {
+			return false
+		}
+		reader.Close()
+		return true
+	}
+	if exists() {
+		return nil
+	}
+	// other instances could create the level at the same time
+	if mh.locking {
+		unlock, err := mh.lockTile(key)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot lock %s", key)
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				mh.log.Errorf("cannot unlock %s: %v", key, err)
+			}
+		}()
+		if exists() {
+			return nil
+		}
+	}
+	reader, _, err := mh.FileOpenRead(ts.cache.Path, filesystem.FileGetOptions{})
+	if err != nil {
+		return emperror.Wrapf(err, "cannot open %s", ts.cache.Path)
+	}
+	im, err := media.NewImageMagickV3(reader)
+	reader.Close()
+	if err != nil {
+		return emperror.Wrapf(err, "cannot load image %s", ts.cache.Path)
+	}
+	defer im.Close()
+	mh.log.Infof("creating tiles of level %v in %s", level, ts.base)
+	return im.Tiles(ts.pyramid, level, func(col, row int64, reader io.Reader, size int64) error {
+		return mh.FileWrite(ts.tilePath(level, col, row), reader, size, filesystem.FilePutOptions{})
+	})
+}
+
+func (mh *MediaHandler) serveTile(resp http.ResponseWriter, req *http.Request, ts *tileSource, level int, col, row int64) {
+	if _, _, _, _, err := ts.pyramid.Tile(level, col, row); err != nil {
+		mh.DoPanicf(resp, http.StatusNotFound, "no tile %v/%v_%v: %v", false, level, col, row, err)
+		return
+	}
+	if err := mh.ensureLevel(ts, level); err != nil {
+		mh.DoPanicf(resp, http.StatusInternalServerError, "cannot create tiles of level %v: %v", false, level, err)
+		return
+	}
+	resp.Header().Set("Content-type", "image/jpeg")
+	if ts.pyramid.Format == "png" {
+		resp.Header().Set("Content-type", "image/png")
+	}
+	mh.ServeContent(resp, req, ts.tilePath(level, col, row))
+}
+
+/*
+ServeTiles delivers deep zoom images for legacy viewers. tiles of a level are created, when the first
+one is requested.
+
+	dzi/image.dzi                         descriptor
+	dzi/image_files/<level>/<col>_<row>.<format>
+	zoomify/ImageProperties.xml
+	zoomify/TileGroup<group>/<tier>-<col>-<row>.jpg
+*/
+func (mh *MediaHandler) ServeTiles(resp http.ResponseWriter, req *http.Request, collection, signature, kind, paramstr string) {
+	ts, err := mh.loadTileSource(collection, signature, kind)
+	if err != nil {
+		mh.DoPanicf(resp, http.StatusBadRequest, "cannot load %s of %s/%s: %v", false, kind, collection, signature, err)
+		return
+	}
+	switch kind {
+	case "dzi":
+		if paramstr == "" || paramstr == "image.dzi" {
+			data, err := ts.pyramid.DZI()
+			if err != nil {
+				mh.DoPanicf(resp, http.StatusInternalServerError, "%v", false, err)
+				return
+			}
+			resp.Header().Set("Content-type", "application/xml")
+			resp.Write(data)
+			return
+		}
+		matches := dziTileRegexp.FindStringSubmatch(paramstr)
+		if matches == nil || matches[4] != ts.pyramid.Format {
+			mh.DoPanicf(resp, http.StatusNotFound, "invalid dzi path %s", false, paramstr)
+			return
+		}
+		level, _ := strconv.Atoi(matches[1])
+		col, _ := strconv.ParseInt(matches[2], 10, 64)
+		row, _ := strconv.ParseInt(matches[3], 10, 64)
+		mh.serveTile(resp, req, ts, level, col, row)
+	case "zoomify":
+		if paramstr == "ImageProperties.xml" {
+			resp.Header().Set("Content-type", "application/xml")
+			resp.Write(ts.pyramid.ZoomifyProperties())
+			return
+		}
+		matches := zoomifyTileRegexp.FindStringSubmatch(paramstr)
+		if matches == nil {
+			mh.DoPanicf(resp, http.StatusNotFound, "invalid zoomify path %s", false, paramstr)
+			return
+		}
+		group, _ := strconv.ParseInt(matches[1], 10, 64)
+		level, _ := strconv.Atoi(matches[2])
+		col, _ := strconv.ParseInt(matches[3], 10, 64)
+		row, _ := strconv.ParseInt(matches[4], 10, 64)
+		if level >= len(ts.pyramid.Levels) || ts.pyramid.TileGroup(level, col, row) != group {
+			mh.DoPanicf(resp, http.StatusNotFound, "no tile %s", false, paramstr)
+			return
+		}
+		mh.serveTile(resp, req, ts, level, col, row)
+	}
+}
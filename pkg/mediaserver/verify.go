@@ -0,0 +1,183 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"github.com/je4/zmedia/v2/pkg/filesystem"
+	"net/http"
+	"os"
+)
+
+// number of cache entries, which are loaded at once for verification
+const verifyBatchSize = 500
+
+type VerifyResult struct {
+	Checked  int64 `json:"checked"`
+	Missing  int64 `json:"missing"`
+	Corrupt  int64 `json:"corrupt"`
+	Repaired int64 `json:"repaired"`
+	Failed   int64 `json:"failed"`
+}
+
+func (mh *MediaHandler) FileStat(path string, opts filesystem.FileStatOptions) (os.FileInfo, error) {
+	fs, bucket, path, err := mh.GetFS(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileStat(bucket, path, opts)
+}
+
+/*
+repairCache removes the cache entry and its file, if it is still missing or corrupt. concurrent repairs wait
+for the first one. the ingested master is always created again, derivatives only with regenerate
+*/
+func (mh *MediaHandler) repairCache(cache *database.Cache, regenerate bool) (*database.Cache, error) {
+	coll, err := cache.GetCollection()
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get collection #%v", cache.CollectionId)
+	}
+	master, err := cache.GetMaster()
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot get master #%v", cache.MasterId)
+	}
+	if _, err := mh.coalesce.Do(cacheKey(coll.Name, master.Signature, cache.Action, cache.Params), func() (*database.Cache, error) {
+		return mh.withLock(coll.Name, master.Signature, cache.Action, cache.Params, func() (*database.Cache, error) {
+			// could have been repaired by another request or instance
+			current, err := mh.mdb.GetCache(coll.Name, master.Signature, cache.Action, cache.Params)
+			if err == database.ErrNotFound {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, emperror.Wrapf(err, "cannot load cache #%v", cache.Id)
+			}
+			if missing, corrupt, err := mh.checkCache(current); err != nil || !(missing || corrupt) {
+				return nil, err
+			}
+			return nil, mh.removeCache(current)
+		})
+	}); err != nil {
+		return nil, err
+	}
+	if !regenerate && !(cache.Action == "master" && cache.Params == "") {
+		return nil, nil
+	}
+	newcache, err := mh.GetCache(coll.Name, master.Signature, cache.Action, cache.Params)
+	if err != nil {
+		return nil, emperror.Wrapf(err, "cannot create %s/%s/%s/%s", coll.Name, master.Signature, cache.Action, cache.Params)
+	}
+	return newcache, nil
+}
+
+// checkCache looks for the file of cache and compares its size
+func (mh *MediaHandler) checkCache(cache *database.Cache) (missing, corrupt bool, err error) {
+	finfo, err := mh.FileStat(cache.Path, filesystem.FileStatOptions{})
+	if err != nil {
+		if filesystem.IsNotFoundError(err) {
+			return true, false, nil
+		}
+		if _, _, _, err2 := mh.GetFS(cache.Path); err2 != nil {
+			// invalid path
+			return true, false, nil
+		}
+		return false, false, emperror.Wrapf(err, "cannot stat %s", cache.Path)
+	}
+	// size of some derivatives is not known
+	if cache.Filesize > 0 && finfo.Size() != cache.Filesize {
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+/*
+VerifyStorage checks the files of all cache entries of storage. broken entries are removed,
+with regenerate they are created again
+*/
+func (mh *MediaHandler) VerifyStorage(storage *database.Storage, regenerate bool) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	var lastId int64
+	for {
+		var num int64
+		if err := mh.mdb.GetCachesByStorage(storage, lastId, verifyBatchSize, func(cache *database.Cache) error {
+			num++
+			lastId = cache.Id
+			result.Checked++
+			missing, corrupt, err := mh.checkCache(cache)
+			if err != nil {
+				mh.log.Errorf("cannot check cache #%v: %v", cache.Id, err)
+				result.Failed++
+				return nil
+			}
+			if !missing && !corrupt {
+				return nil
+			}
+			if missing {
+				result.Missing++
+			} else {
+				result.Corrupt++
+			}
+			mh.log.Warningf("cache #%v %s/%s %s: missing=%v corrupt=%v", cache.Id, cache.Action, cache.Params, cache.Path, missing, corrupt)
+			if _, err := mh.repairCache(cache, regenerate); err != nil {
+				mh.log.Errorf("cannot repair cache #%v: %v", cache.Id, err)
+				result.Failed++
+				return nil
+			}
+			result.Repaired++
+			return nil
+		}); err != nil {
+			return result, emperror.Wrapf(err, "cannot list cache entries of storage %s", storage.Name)
+		}
+		if num < verifyBatchSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Verify checks the cache entries of all storages
+func (mh *MediaHandler) Verify(regenerate bool) error {
+	var storages []*database.Storage
+	if err := mh.mdb.GetStorages(func(storage *database.Storage) error {
+		storages = append(storages, storage)
+		return nil
+	}); err != nil {
+		return emperror.Wrap(err, "cannot load storages")
+	}
+	var failed int64
+	for _, storage := range storages {
+		result, err := mh.VerifyStorage(storage, regenerate)
+		if err != nil {
+			return emperror.Wrapf(err, "cannot verify storage %s", storage.Name)
+		}
+		mh.log.Infof("storage %s: %v checked, %v missing, %v corrupt, %v repaired, %v failed",
+			storage.Name, result.Checked, result.Missing, result.Corrupt, result.Repaired, result.Failed)
+		failed += result.Failed
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v cache entries could not be verified or repaired", failed)
+	}
+	return nil
+}
+
+// ServeCache delivers the file of cache. a missing file is created again
+func (mh *MediaHandler) ServeCache(w http.ResponseWriter, r *http.Request, cache *database.Cache) {
+	reader, finfo, err := mh.FileOpenRead(cache.Path, filesystem.FileGetOptions{})
+	if err != nil {
+		if missing, _, serr := mh.checkCache(cache); serr != nil || !missing {
+			mh.DoPanicf(w, http.StatusNotFound, "cannot open %s: %v", false, cache.Path, err)
+			return
+		}
+		mh.log.Warningf("file %s of cache #%v is missing", cache.Path, cache.Id)
+		repaired, err := mh.repairCache(cache, true)
+		if err != nil {
+			mh.DoPanicf(w, http.StatusNotFound, "cannot recreate %s: %v", false, cache.Path, err)
+			return
+		}
+		if reader, finfo, err = mh.FileOpenRead(repaired.Path, filesystem.FileGetOptions{}); err != nil {
+			mh.DoPanicf(w, http.StatusNotFound, "cannot open %s: %v", false, repaired.Path, err)
+			return
+		}
+	}
+	defer reader.Close()
+	http.ServeContent(w, r, finfo.Name(), finfo.ModTime(), reader)
+}
@@ -0,0 +1,188 @@
+package mediaserver
+
+import (
+	"fmt"
+	"github.com/goph/emperror"
+	"github.com/je4/zmedia/v2/pkg/database"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// masters, which wait for the background warm-up. more are skipped
+const warmupQueueSize = 10000
+
+/*
+SetWarmup defines the presets per master type, which are created after ingest. parallel masters
+are warmed up at the same time in the background
+*/
+func (mh *MediaHandler) SetWarmup(rules map[string][]string, parallel int) {
+	mh.warmup = make(map[string][]string)
+	for mtype, presets := range rules {
+		mh.warmup[strings.ToLower(mtype)] = presets
+	}
+	mh.warmers = parallel
+}
+
+type warmupDerivative struct {
+	action, paramstr string
+}
+
+type warmupTask struct {
+	collection, signature string
+	derivatives           []warmupDerivative
+}
+
+func (mh *MediaHandler) warmupWorker() {
+	for task := range mh.warmQueue {
+		for _, d := range task.derivatives {
+			if _, err := mh.GetCache(task.collection, task.signature, d.action, d.paramstr); err != nil {
+				mh.log.Errorf("cannot create %s/%s of %s/%s: %v", d.action, d.paramstr, task.collection, task.signature, err)
+			}
+		}
+	}
+}
+
+// queueWarmup starts the workers on first use. without space in the queue, derivatives are created on request
+func (mh *MediaHandler) queueWarmup(task *warmupTask) {
+	mh.warmOnce.Do(func() {
+		workers := mh.warmers
+		if workers < 1 {
+			workers = 1
+		}
+		mh.warmQueue = make(chan *warmupTask, warmupQueueSize)
+		for i := 0; i < workers; i++ {
+			go mh.warmupWorker()
+		}
+	})
+	select {
+	case mh.warmQueue <- task:
+	default:
+		mh.log.Warningf("warm-up queue full, %s/%s skipped", task.collection, task.signature)
+	}
+}
+
+// rules of the collection replace the global rules
+func (mh *MediaHandler) warmupPresets(coll *database.Collection, masterType string) []string {
+	masterType = strings.ToLower(masterType)
+	if coll.Config.Warmup != nil {
+		for mtype, presets := range coll.Config.Warmup {
+			if strings.ToLower(mtype) == masterType {
+				return presets
+			}
+		}
+		return nil
+	}
+	return mh.warmup[masterType]
+}
+
+// Warmup ingests the master and creates the derivatives of its warm-up presets
+func (mh *MediaHandler) Warmup(collection, signature string) error {
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	if _, err := mh.GetCache(collection, signature, "master", ""); err != nil {
+		return emperror.Wrapf(err, "cannot ingest master %s/%s", collection, signature)
+	}
+	master, err := mh.mdb.GetMaster(coll, signature)
+	if err != nil {
+		return emperror.Wrapf(err, "cannot load master %s/%s", collection, signature)
+	}
+	var errs []string
+	for _, preset := range mh.warmupPresets(coll, master.Type) {
+		if _, err := mh.GetCache(collection, signature, "preset", preset); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", preset, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot create presets of %s/%s: %s", collection, signature, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/*
+startWarmup creates the warm-up presets and the text of a new master in the background.
+with job queue, they are queued as jobs
+*/
+func (mh *MediaHandler) startWarmup(coll *database.Collection, master *database.Master) {
+	var derivatives []warmupDerivative
+	for _, preset := range mh.warmupPresets(coll, master.Type) {
+		action, paramstr, err := mh.resolvePreset(coll.Name, preset)
+		if err == nil {
+			_, paramstr, err = mh.normalize(action, paramstr)
+		}
+		if err != nil {
+			mh.log.Errorf("invalid preset %s of %s/%s: %v", preset, coll.Name, master.Signature, err)
+			continue
+		}
+		derivatives = append(derivatives, warmupDerivative{action: action, paramstr: paramstr})
+	}
+	// text recognition takes too long to run within the ingest
+	if mh.ocr != nil && mh.ocrIngest && mh.ocr.Supports(master.Mimetype) {
+		derivatives = append(derivatives, warmupDerivative{action: "ocr", paramstr: "formattxt"})
+	}
+	if len(derivatives) == 0 {
+		return
+	}
+	if mh.jobs != nil {
+		for _, d := range derivatives {
+			if _, err := mh.jobs.Enqueue(coll.Name, master.Signature, d.action, d.paramstr); err != nil {
+				mh.log.Errorf("cannot queue %s/%s of %s/%s: %v", d.action, d.paramstr, coll.Name, master.Signature, err)
+			}
+		}
+		return
+	}
+	mh.queueWarmup(&warmupTask{collection: coll.Name, signature: master.Signature, derivatives: derivatives})
+}
+
+// WarmupProgress is called after every master
+type WarmupProgress func(done, failed, total int64)
+
+// WarmupCollection warms all masters of collection with parallel workers
+func (mh *MediaHandler) WarmupCollection(collection string, parallel int, progress WarmupProgress) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	coll, err := mh.mdb.GetCollectionByName(collection)
+	if err != nil {
+		return emperror.Wrapf(err, "invalid collection %s", collection)
+	}
+	var signatures []string
+	if err := mh.mdb.GetMasterSignatures(coll, func(signature string) error {
+		signatures = append(signatures, signature)
+		return nil
+	}); err != nil {
+		return emperror.Wrapf(err, "cannot list masters of %s", collection)
+	}
+
+	total := int64(len(signatures))
+	var done, failed int64
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for signature := range queue {
+				if err := mh.Warmup(coll.Name, signature); err != nil {
+					mh.log.Errorf("warmup of %s/%s failed: %v", coll.Name, signature, err)
+					atomic.AddInt64(&failed, 1)
+				}
+				current := atomic.AddInt64(&done, 1)
+				if progress != nil {
+					progress(current, atomic.LoadInt64(&failed), total)
+				}
+			}
+		}()
+	}
+	for _, signature := range signatures {
+		queue <- signature
+	}
+	close(queue)
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("warmup of %v from %v masters in %s failed", failed, total, collection)
+	}
+	return nil
+}